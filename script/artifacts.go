@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// artifactFolder is the folder in a project where cbug saves what it brings
+// back from the container, like core dumps and profiles. It is left out when
+// the project is copied into a container.
+const artifactFolder = ".cbug"
+
+// artifactDir makes a folder in the project's .cbug folder, falling back to
+// the current directory if the project root isn't known
+func artifactDir(conf configStruct, parts ...string) (string, error) {
+	root := projectRoot(conf)
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+	dir := filepath.Join(append([]string{root, artifactFolder}, parts...)...)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// copyOut copies a file out of the container to this computer
+func copyOut(conf configStruct, containerFile string, hostFile string) error {
+	return exec.Command("docker", "cp", conf.ContainerName+":"+containerFile, hostFile).Run()
+}
+
+// moveOut copies a file out of the container, then removes it there so it
+// doesn't sit in the container's files
+func moveOut(conf configStruct, containerFile string, hostFile string) error {
+	if err := copyOut(conf, containerFile, hostFile); err != nil {
+		return err
+	}
+	exec.Command("docker", "exec", conf.ContainerName, "rm", "-f", containerFile).Run()
+	return nil
+}
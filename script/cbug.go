@@ -11,15 +11,14 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/google/go-github/v50/github"
@@ -27,25 +26,78 @@ import (
 
 type flagStruct struct {
 	keepalive bool
+	idle      idleBehaviour
 	pause     bool
 	stop      bool
 	sync      bool
 	tty       bool
-	forceX86  bool
-	forceArm  bool
+	noTty     bool
+	arch      string
+	resources resourceLimits
+	env       []string
+	envFiles  []string
+	workdir   string
+	hostPaths string
+	timeout   time.Duration
+	backtrace bool
+	stats     bool
+	noCore    bool
+	noASLR    bool
+}
+
+// valueFlags are the flags that take the argument after them as a value
+var valueFlags = map[string]bool{
+	"-n":            true,
+	"--name":        true,
+	"--arch":        true,
+	"--memory":      true,
+	"--memory-swap": true,
+	"--cpus":        true,
+	"--pids":        true,
+	"-e":            true,
+	"--env":         true,
+	"--env-file":    true,
+	"-w":            true,
+	"--workdir":     true,
+	"--idle":        true,
+	"--timeout":     true,
 }
 
 type configStruct struct {
-	ContainerName    string `json:"containerName"`
-	DefaultBehaviour string `json:"exitBehaviourDefault"`
-	DockerContainer  string `json:"imageName"`
+	ContainerName    string            `json:"containerName"`
+	DefaultBehaviour string            `json:"exitBehaviourDefault"`
+	DockerContainer  string            `json:"imageName"`
+	Resources        resourceLimits    `json:"resources,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	PassEnv          []string          `json:"passEnv,omitempty"`
+	ProjectRoot      string            `json:"projectRoot,omitempty"`
+	HostPaths        string            `json:"hostPaths,omitempty"`
+	GdbInit          string            `json:"gdbinit,omitempty"`
+}
+
+// configPath is where the config is read from and saved to. It is kept in
+// the user's config folder, so that cbug works when it is installed somewhere
+// it can't write to. A config.json in the cbug folder overrides it.
+func configPath(execLoc string) string {
+	local := filepath.Join(filepath.Dir(execLoc), "..", "config.json")
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return local
+	}
+	return filepath.Join(dir, "cbug", "config.json")
 }
 
 type infoStruct struct {
 	Version            string `json:"version"`
 	Platform           string `json:"target"`
 	ArchitectureString string `json:"architecture"`
-	Tag                DTag
+}
+
+func (info infoStruct) arch() string {
+	return normalizeArch(info.ArchitectureString)
 }
 
 func ifErr(err error, errMsg string, printErr bool) {
@@ -59,21 +111,39 @@ func ifErr(err error, errMsg string, printErr bool) {
 	}
 }
 
-func selectedTag(info infoStruct, flags flagStruct) string {
-	if flags.forceArm {
-		return string(DTagArm)
+// defaultBehaviour sets the exit behaviour from the config, for when no flag
+// picked one
+func defaultBehaviour(conf configStruct, flags *flagStruct) error {
+	switch {
+	case conf.DefaultBehaviour == "pause":
+		flags.pause = true
+	case conf.DefaultBehaviour == "keep-alive":
+		flags.keepalive = true
+	case strings.HasPrefix(conf.DefaultBehaviour, "idle:"):
+		idle, err := parseIdle(strings.TrimPrefix(conf.DefaultBehaviour, "idle:"))
+		if err != nil {
+			return err
+		}
+		flags.idle = idle
+	default:
+		flags.stop = true
 	}
-	if flags.forceX86 {
-		return string(DTagX86)
+	return nil
+}
+
+func forceArch(flags *flagStruct, arch string) {
+	if flags.arch != "" && flags.arch != arch {
+		fmt.Println("cannot force both " + flags.arch + " and " + arch)
+		os.Exit(1)
 	}
-	return string(info.Tag)
+	flags.arch = arch
 }
 
-func doImagePull(dockerCli *client.Client, image string) bool {
+func doImagePull(dockerCli *client.Client, image string, platform string) bool {
 	closer, err := dockerCli.ImagePull(context.Background(), image, types.ImagePullOptions{
 		All:          false,
 		RegistryAuth: "",
-		Platform:     "",
+		Platform:     platform,
 	})
 	var in = make([]byte, 8)
 	fullStatus := ""
@@ -144,14 +214,16 @@ func unzipFile(f *zip.File, destination string) error {
 	return nil
 }
 
-func getTag(instr string) (DTag, error) {
-	switch instr {
+// legacyTag gives the tag an architecture was published under before the
+// cbug image was a manifest list
+func legacyTag(arch string) (DTag, bool) {
+	switch arch {
 	case "arm64":
-		return DTagArm, nil
-	case "x86":
-		return DTagX86, nil
+		return DTagArm, true
+	case "amd64":
+		return DTagX86, true
 	}
-	return "", errors.New("unrecognized architecture")
+	return "", false
 }
 
 type DTag string
@@ -161,17 +233,6 @@ const (
 	DTagArm DTag = "latest"
 )
 
-func (t DTag) readable() string {
-	switch t {
-	case DTagX86:
-		return "x86"
-	case DTagArm:
-		return "arm"
-	default:
-		return ""
-	}
-}
-
 func getNewRelease(releaseInfo infoStruct) bool {
 	fmt.Println("Checking for new cbug version...")
 	gitCli := github.NewClient(nil)
@@ -230,14 +291,104 @@ func getNewRelease(releaseInfo infoStruct) bool {
 	return true
 }
 
+// createContainer makes a new cbug container named conf.ContainerName for
+// arch, pulling the image first if needed, and returns its ID. debug gives it
+// what debuggers need, which other containers go without.
+func createContainer(dockerCli *client.Client, conf configStruct, releaseInfo infoStruct, arch string, debug bool) string {
+	if arch != releaseInfo.arch() {
+		if supported, reason := emulationSupport(dockerCli, arch); !supported {
+			fmt.Println("Error: unable to create a " + arch + " container, " + reason + ".")
+			fmt.Println("To fix this, " + emulationHint + ", or run cbug without forcing an architecture.")
+			os.Exit(1)
+		}
+	}
+
+	image, err := resolveImage(dockerCli, conf, arch)
+	ifErr(err, "Error finding cbug docker image: ", true)
+	if !imageHasArch(dockerCli, image, arch) {
+		fmt.Print("Pulling cbug docker image...")
+		doImagePull(dockerCli, image, "linux/"+arch)
+		fmt.Println("Done")
+	}
+
+	fmt.Print("Creating New Docker Container...")
+	platform := specs.Platform{}
+	if arch != releaseInfo.arch() {
+		platform.Architecture = arch
+		platform.OS = "linux"
+	}
+
+	resources, err := conf.Resources.dockerResources()
+	ifErr(err, "\n\nError in config: ", true)
+
+	hostConfig := &container.HostConfig{
+		Resources: resources,
+		//debuggers on this computer connect to gdbserver through this.
+		//docker picks a free port, and it is only reachable locally.
+		PortBindings: nat.PortMap{debugPort: {{HostIP: "127.0.0.1"}}},
+	}
+	labels := map[string]string{cbugLabel: "1"}
+	if debug {
+		hostConfig.CapAdd = debugCapabilities
+		hostConfig.SecurityOpt = []string{"seccomp=" + debugSeccompProfile()}
+		labels[debugLabel] = "1"
+	}
+
+	cont, err := dockerCli.ContainerCreate(
+		context.Background(),
+		&container.Config{
+			Hostname:        "",
+			Domainname:      "",
+			User:            "",
+			AttachStdin:     true,
+			AttachStdout:    true,
+			AttachStderr:    true,
+			ExposedPorts:    nat.PortSet{debugPort: struct{}{}},
+			Tty:             true,
+			OpenStdin:       true,
+			StdinOnce:       false,
+			Env:             []string{},
+			Healthcheck:     &container.HealthConfig{},
+			ArgsEscaped:     false,
+			Image:           image,
+			Volumes:         map[string]struct{}{},
+			WorkingDir:      "/debugger",
+			Entrypoint:      []string{},
+			NetworkDisabled: false,
+			MacAddress:      "",
+			OnBuild:         []string{},
+			Labels:          labels,
+			StopSignal:      "",
+			StopTimeout:     new(int),
+			Shell:           []string{},
+		},
+		hostConfig,
+		nil,
+		&platform,
+		conf.ContainerName,
+	)
+	ifErr(err, "\n\nError creating Docker container: ", true)
+	fmt.Print("Done\n\n")
+	return cont.ID
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run is cbug itself. It returns the exit code instead of exiting, so that
+// everything deferred, like stopping the container, runs first.
+func run() int {
+	exitCode := 0
 
 	execLoc, err := os.Executable()
 	ifErr(err, "Error getting location of cbug: ", true)
-	if _, err = os.Stat(filepath.Dir(execLoc) + "/../config.json"); errors.Is(err, os.ErrNotExist) {
-		os.WriteFile(filepath.Dir(execLoc)+"/../config.json", []byte(`{"containerName": "cbug","exitBehaviourDefault": "shutdown"}`), 0644)
+	confPath := configPath(execLoc)
+	if _, err = os.Stat(confPath); errors.Is(err, os.ErrNotExist) {
+		os.MkdirAll(filepath.Dir(confPath), 0755)
+		os.WriteFile(confPath, []byte(`{"containerName": "cbug","exitBehaviourDefault": "shutdown"}`), 0644)
 	}
-	confFile, err := ioutil.ReadFile(filepath.Dir(execLoc) + "/../config.json")
+	confFile, err := ioutil.ReadFile(confPath)
 	conf := configStruct{}
 	_ = json.Unmarshal([]byte(confFile), &conf)
 
@@ -255,93 +406,165 @@ func main() {
 	}
 
 	//flag handling
-	oneTimeContainerName := false
+	takesValue := false
 	var flagSlice = []string{}
 	for index, arg := range osArgs {
-		if oneTimeContainerName {
-			oneTimeContainerName = false
-			conf.ContainerName = arg
+		if takesValue {
+			takesValue = false
+			flagSlice = append(flagSlice, arg)
 			continue
 		}
-		if arg == "-n" || arg == "--name" {
-			oneTimeContainerName = true
-		} else if arg[0] != '-' {
+		if arg[0] != '-' {
 			args = osArgs[index:]
 			break
-		} else {
-			flagSlice = append(flagSlice, arg)
 		}
+		flagSlice = append(flagSlice, arg)
+		takesValue = valueFlags[arg]
+	}
+	//cbug dap talks to the editor over stdout, so everything else cbug
+	//prints goes to stderr instead
+	dapOut := os.Stdout
+	if len(args) > 0 && args[0] == "dap" {
+		os.Stdout = os.Stderr
 	}
 
-	for _, flag := range flagSlice {
+	if takesValue {
+		fmt.Println("Missing value for cbug flag \"" + flagSlice[len(flagSlice)-1] + "\"")
+		os.Exit(1)
+	}
+
+	for i := 0; i < len(flagSlice); i++ {
+		flag := flagSlice[i]
+		value := ""
+		if valueFlags[flag] {
+			i++
+			value = flagSlice[i]
+		}
 		switch flag {
+		case "-n", "--name":
+			conf.ContainerName = value
 		case "-k", "--keep-alive":
-			if !flags.pause && !flags.stop {
+			if !flags.pause && !flags.stop && flags.idle.after == 0 {
 				flags.keepalive = true
 			} else {
 				fmt.Println("Conflicting flags present")
 				os.Exit(1)
 			}
 		case "-p", "--pause":
-			if !flags.keepalive && !flags.stop {
+			if !flags.keepalive && !flags.stop && flags.idle.after == 0 {
 				flags.pause = true
 			} else {
 				fmt.Println("Conflicting flags present")
 				os.Exit(1)
 			}
 		case "-s", "--shutdown":
-			if !flags.keepalive && !flags.pause {
+			if !flags.keepalive && !flags.pause && flags.idle.after == 0 {
 				flags.stop = true
 			} else {
 				fmt.Println("Conflicting flags present")
 				os.Exit(1)
 			}
+		case "--idle":
+			if flags.keepalive || flags.pause || flags.stop {
+				fmt.Println("Conflicting flags present")
+				os.Exit(1)
+			}
+			idle, err := parseIdle(value)
+			ifErr(err, "Error: ", true)
+			flags.idle = idle
 		case "-S", "--sync":
 			flags.sync = true
 		case "-t", "--tty":
+			if flags.noTty {
+				fmt.Println("Conflicting flags present")
+				os.Exit(1)
+			}
 			flags.tty = true
-		case "-a", "--arm":
-			if flags.forceX86 {
-				fmt.Println("cannot force x86 and force arm")
+		case "-T", "--no-tty":
+			if flags.tty {
+				fmt.Println("Conflicting flags present")
 				os.Exit(1)
 			}
-			flags.forceArm = true
+			flags.noTty = true
+		case "-a", "--arm":
+			forceArch(&flags, "arm64")
 		case "-x", "--x86":
-			if flags.forceArm {
-				fmt.Println("cannot force x86 and force arm")
+			forceArch(&flags, "amd64")
+		case "--arch":
+			forceArch(&flags, parseArch(value))
+		case "--memory":
+			flags.resources.Memory = value
+		case "--memory-swap":
+			flags.resources.MemorySwap = value
+		case "--cpus":
+			flags.resources.CPUs = value
+		case "--pids":
+			flags.resources.Pids = value
+		case "-e", "--env":
+			flags.env = append(flags.env, value)
+		case "--env-file":
+			flags.envFiles = append(flags.envFiles, value)
+		case "-w", "--workdir":
+			flags.workdir = value
+		case "--host-paths":
+			flags.hostPaths = "always"
+		case "--no-host-paths":
+			flags.hostPaths = "never"
+		case "--timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				fmt.Println("Invalid timeout \"" + value + "\", use a time like 30s or 5m")
 				os.Exit(1)
 			}
-			flags.forceX86 = true
+			flags.timeout = timeout
+		case "--timeout-backtrace":
+			flags.backtrace = true
+		case "--stats":
+			flags.stats = true
+		case "--no-core":
+			flags.noCore = true
+		case "--no-aslr":
+			flags.noASLR = true
 		default:
 			fmt.Println("Unknown cbug flag \"" + flag + "\"")
 			os.Exit(1)
 		}
 	}
-	if !flags.pause && !flags.keepalive && !flags.stop {
-		switch conf.DefaultBehaviour {
-		case "pause":
-			flags.pause = true
-		case "keep-alive":
+	if len(args) == 0 {
+		fmt.Println("Error, no argument given to cbug")
+		os.Exit(1)
+	}
+	if !flags.pause && !flags.keepalive && !flags.stop && flags.idle.after == 0 {
+		switch {
+		case args[0] == "session" && len(args) > 1 && args[1] == "start":
+			//the container is left for the session to stop
+			flags.keepalive = true
+		case args[0] != "session" && inSession(conf.ContainerName):
+			//a session decides when the container stops, not its commands
 			flags.keepalive = true
 		default:
-			flags.stop = true
+			//doctor reports a bad exit behaviour along with everything else
+			if err := defaultBehaviour(conf, &flags); args[0] != "doctor" {
+				ifErr(err, "Error in config exitBehaviourDefault: ", true)
+			}
 		}
 	}
 
-	if _, err = os.Stat(filepath.Dir(execLoc) + "/../release-info.json"); errors.Is(err, os.ErrNotExist) {
-		fmt.Println("CRITICAL ERROR: no release-info file. Please re-add this file or redownload cbug.")
-		os.Exit(1)
+	if args[0] == idleWatchCommand {
+		watchIdle(args[1:])
+		return 0
+	}
+	if args[0] == sessionWatchCommand {
+		watchSession(execLoc, flags, args[1:])
+		return 0
 	}
-	infoFile, err := ioutil.ReadFile(filepath.Dir(execLoc) + "/../release-info.json")
-	releaseInfo := infoStruct{}
-	_ = json.Unmarshal([]byte(infoFile), &releaseInfo)
-	releaseInfo.Tag, err = getTag(releaseInfo.ArchitectureString)
-	ifErr(err, "Error: ", true)
 
-	if len(args) == 0 {
-		fmt.Println("Error, no argument given to cbug")
-		os.Exit(1)
+	releaseInfo, releaseErr := loadReleaseInfo(execLoc)
+	if args[0] == "doctor" {
+		runDoctor(execLoc, conf, releaseInfo, releaseErr, flags, args)
+		return 0
 	}
+	ifErr(releaseErr, "Error reading release info: ", true)
 
 	//should run help command (and maybe others so its in switch) before touching docker
 	switch args[0] {
@@ -351,10 +574,22 @@ func main() {
 			"\tsync: runs clean and then copies the current directory to cbug.\n" +
 			"\tconfig: configure the default behaviour of cbug.\n" +
 			"\tremove [name]: remove container with [name]. If no name is given, it will remove the default container. Will not remove non cbug containers.\n" +
-			"\tattach: attach current terminal to the cbug container. Useful for executing many commands back to back\n" +
+			"\tshell: open a new bash shell in the cbug container, in the directory matching the current one. Useful for executing many commands back to back\n" +
+			"\tattach: attach current terminal to the cbug container's main shell. Exiting it stops the container, so shell is usually better\n" +
 			"\tdefault: if none of these commands are present, the command will be passed\n" +
 			"\tupgrade: check for updates to cbug\n" +
 			"\tinfo: view information on cbug\n" +
+			"\tmatrix [--arch a,b] [--compiler a,b] [--opt a,b] -- <build> ; <run>: build and run in every combination and compare the results\n" +
+			"\tdoctor [--json]: check docker, the cbug image and configuration for problems\n" +
+			"\tgdb <program> [args]: debug a program with gdb. Containers made by older versions of cbug are recreated to allow debugging, keeping their files\n" +
+			"\tdebug-server <program> [args]: run a program under gdbserver, for debuggers and editors on this computer to connect to. Writes .cbug/gdbinit to connect with gdb\n" +
+			"\tmemcheck [--debug-on-error] <program> [args]: check a program for memory errors with valgrind. --debug-on-error stops at the first error and opens gdb there\n" +
+			"\theap [--html file] [--svg file] <program> [args]: record a program's heap use with valgrind's massif, and chart it with the biggest allocation sites at its peak\n" +
+			"\tprofile [--cache] [-o file] <program> [args]: profile a program with valgrind's callgrind (or cachegrind with --cache), and save it for go tool pprof\n" +
+			"\tthreads [--drd] <program> [args]: find data races and lock order problems with valgrind's helgrind (or drd with --drd), grouping repeated reports\n" +
+			"\tdap: serve the Debug Adapter Protocol over stdin and stdout, for editors to debug programs in the container with gdb. Paths in /debugger are mapped to the project on this computer\n" +
+			"\ttop: show the cpu, memory and process use of running cbug containers, updating live\n" +
+			"\tsession start|end: keep the container running for commands in this shell until it exits or the session is ended\n" +
 			"\t         directly to the cbug container.\n" +
 			"FLAGS:\n" +
 			"\t*flags only work when passing commands to the cbug container, not on " +
@@ -362,21 +597,34 @@ func main() {
 			"\t-k, --keep-alive: do not pause or shut down the container when cbug exits\n" +
 			"\t-s, --shutdown: shut down the container when cbug exits\n" +
 			"\t-p, --pause: pause those container when cbug exits\n" +
+			"\t--idle [time[:pause]]: leave the container running, and shut it down (or pause it) once cbug hasn't been used for this long (e.g. --idle 30m)\n" +
 			"\t-S, --sync: sync files before running command given\n" +
-			"\t-t, --tty: run commands through a tty shell. good for formatting, but will break streaming files into stdin (e.g. using < input.txt)\n" +
+			"\t-t, --tty: run commands through a tty shell. good for formatting, but will break streaming files into stdin (e.g. using < input.txt). By default a tty is used when cbug is run from a terminal without redirection\n" +
+			"\t-T, --no-tty: never run commands through a tty shell\n" +
 			"\t-n, --name: change the name of the container for this command. Does not effect the default conifg" +
-			"\t-x, --x86: force cbug to use an x86 container (works on all machines). If used on an existing arm container, it will not work." +
-			"\t-a, --arm: force cbug to use an arm container (works on all machines). If used on an existing x86 container, it will not work.")
-		return
+			"\t-x, --x86: force cbug to use an x86 container (works on all machines). If used on an existing arm container, it will not work.\n" +
+			"\t--memory, --memory-swap, --cpus, --pids [limit]: limit the resources of the container for this command (e.g. --memory 256m --cpus 1 --pids 64)\n" +
+			"\t-e, --env [KEY=VAL]: set an environment variable for this command. Just KEY passes through the value from this computer.\n" +
+			"\t--env-file [file]: set the environment variables listed in a file for this command\n" +
+			"\t-w, --workdir [dir]: run the command in this directory in the container instead of the one matching the current directory\n" +
+			"\t--timeout [time]: kill the command and everything it started if it runs for longer than this (e.g. --timeout 30s). cbug exits with 124 when this happens\n" +
+			"\t--timeout-backtrace: print a backtrace of every thread with gdb before killing a command that timed out\n" +
+			"\t--stats: report the wall time, cpu time, peak memory and most open files of the command when it finishes\n" +
+			"\t--no-core: don't save a core dump and print a backtrace when the command crashes\n" +
+			"\t--no-aslr: turn off address space randomization for cbug gdb, so addresses are the same every run\n" +
+			"\t--host-paths, --no-host-paths: always or never rewrite /debugger paths in the output to paths on this computer. By default this is only done when output is a terminal\n" +
+			"\t-a, --arm: force cbug to use an arm container (works on all machines). If used on an existing x86 container, it will not work.\n" +
+			"\t--arch [architecture]: force cbug to use a container for any architecture the cbug image is published for (e.g. riscv64, ppc64le).")
+		return 0
 	case "config":
 		if len(args) > 1 && args[1] == "default" {
 			conf.ContainerName = "cbug"
 			conf.DefaultBehaviour = "shutdown"
 			newConfigJson, err := json.Marshal(conf)
 			ifErr(err, "Error sending new config to config file", false)
-			os.WriteFile(filepath.Dir(execLoc)+"/config.json", newConfigJson, 0644)
+			os.WriteFile(confPath, newConfigJson, 0644)
 			fmt.Println("reset cbug to its default configuration")
-			return
+			return 0
 		}
 		fmt.Print("New cbug container name (leave empty to remain as \"" + conf.ContainerName + "\"): ")
 		var newContainerName string
@@ -384,23 +632,29 @@ func main() {
 		if newContainerName != "" {
 			conf.ContainerName = newContainerName
 		}
-		fmt.Print("New container default behaviour (shutdown, pause, or keep-alive. Leave black to remain as \"" + conf.DefaultBehaviour + "\"): ")
+		fmt.Print("New container default behaviour (shutdown, pause, keep-alive, or idle:<time>[:pause] e.g. idle:30m. Leave black to remain as \"" + conf.DefaultBehaviour + "\"): ")
 		var newBehaviour string
 		fmt.Scanf("%s", &newBehaviour)
-		switch newBehaviour {
-		case "shutdown", "pause", "keep-alive":
+		switch {
+		case newBehaviour == "shutdown", newBehaviour == "pause", newBehaviour == "keep-alive":
+			conf.DefaultBehaviour = newBehaviour
+		case strings.HasPrefix(newBehaviour, "idle:"):
+			if _, err := parseIdle(strings.TrimPrefix(newBehaviour, "idle:")); err != nil {
+				fmt.Println(err.Error())
+				return 0
+			}
 			conf.DefaultBehaviour = newBehaviour
-		case "":
+		case newBehaviour == "":
 			break
 		default:
 			fmt.Println("unrecognized behaviour")
-			return
+			return 0
 		}
 		newConfigJson, err := json.Marshal(conf)
 		ifErr(err, "Error sending new config to config file", false)
-		os.WriteFile(filepath.Dir(execLoc)+"/../config.json", newConfigJson, 0644)
+		os.WriteFile(confPath, newConfigJson, 0644)
 
-		return
+		return 0
 	case "remove":
 		//NOTE: this cannot implement the whole command because needs docker
 		if len(args) > 1 {
@@ -408,7 +662,9 @@ func main() {
 		}
 	case "info":
 		fmt.Println("cbug version: " + releaseInfo.Version)
-		return
+		fmt.Println("platform: " + releaseInfo.Platform + " (" + releaseInfo.arch() + ")")
+		printContainerInfo(conf)
+		return 0
 	}
 
 	//starting handling docker
@@ -416,10 +672,20 @@ func main() {
 	dockerCli, err := client.NewEnvClient()
 	ifErr(err, "Unable to connect to docker. Have you installed docker on your machine and is it running?", false)
 
+	if args[0] == "top" {
+		runTop(dockerCli, conf)
+		return 0
+	}
+	if args[0] == "matrix" {
+		env, err := execEnv(conf, flags)
+		ifErr(err, "Error: ", true)
+		return runMatrix(execLoc, dockerCli, conf, releaseInfo, flags, env, args[1:])
+	}
+
 	if args[0] == "upgrade" {
 		if releaseInfo.Version == "dev" {
 			fmt.Println("You are currently on a development version of cbug, so no updates are allowed.")
-			return
+			return 0
 		}
 		fmt.Println("checking for and downloading new docker containers...")
 		images, err := dockerCli.ImageList(context.Background(), types.ImageListOptions{All: true})
@@ -427,8 +693,10 @@ func main() {
 		anyNew := false
 		for _, image := range images {
 			for _, label := range image.RepoTags {
-				if strings.Contains(label, "eleanormally/cpp-memory-debugger") {
-					if doImagePull(dockerCli, label) {
+				if isCbugImage(conf, label) {
+					imageInfo, _, err := dockerCli.ImageInspectWithRaw(context.Background(), image.ID)
+					ifErr(err, "Error inspecting docker image: ", true)
+					if doImagePull(dockerCli, label, "linux/"+imageInfo.Architecture) {
 						fmt.Println("Upgraded docker image " + label + ". THIS HAS NOT UPGRADED ANY CBUG CONTAINERS. Please remove all existing cbug containers and recreate them to use the new version.")
 						anyNew = true
 					}
@@ -442,9 +710,13 @@ func main() {
 		if !getNewRelease(releaseInfo) {
 			os.Exit(1)
 		}
-		return
+		return 0
 	}
 
+	containerLease, err := acquireLease(conf.ContainerName)
+	ifErr(err, "Error registering with cbug container: ", true)
+	defer containerLease.release()
+
 	containers, err := dockerCli.ContainerList(context.Background(), types.ContainerListOptions{
 		All: true,
 	})
@@ -454,7 +726,7 @@ func main() {
 	for _, dContainer := range containers {
 		for _, name := range dContainer.Names {
 			if name == "/"+conf.ContainerName {
-				if strings.Contains(dContainer.Image, "eleanormally/cpp-memory-debugger") {
+				if isCbugContainer(conf, dContainer) {
 					//remove needs to be up here so that don't accidentally create new container if name not found
 					if args[0] == "remove" {
 						delay := time.Duration(1) * time.Millisecond
@@ -466,25 +738,24 @@ func main() {
 							Force:         false,
 						})
 						ifErr(err, "Error removing container: ", true)
+						clearState(conf.ContainerName)
 						fmt.Println("Done")
-						return
+						return 0
 					}
-					if (!flags.forceArm && !flags.forceX86) || strings.Contains(dContainer.Image, selectedTag(releaseInfo, flags)) {
-						fmt.Println(selectedTag(releaseInfo, flags) + " " + dContainer.Image)
+					if flags.arch == "" {
 						containerID = dContainer.ID
 					} else {
-						if flags.forceArm {
-							fmt.Println("Error: This container is for x86, please remove this container or specify a name for a new container.")
-							os.Exit(1)
-						}
-						if flags.forceX86 {
-							fmt.Println("Error: This container is for arm, please remove this container or specify a name for a new container.")
+						arch, err := containerArch(dockerCli, dContainer.ID)
+						ifErr(err, "Error inspecting Docker container: ", true)
+						if arch != flags.arch {
+							fmt.Println("Error: This container is for " + arch + ", please remove this container or specify a name for a new container.")
 							os.Exit(1)
 						}
+						containerID = dContainer.ID
 					}
 				} else {
 					fmt.Println("Error: found a docker container with the name \"" + conf.ContainerName + "\" in use not by cbug.\nPlease rename/delete the container named \"" + conf.ContainerName + "\", or use \"cbug config\" to change the name of cbug's container")
-					return
+					return 0
 				}
 				break
 			}
@@ -492,183 +763,167 @@ func main() {
 	}
 	if args[0] == "remove" {
 		fmt.Println("Could not find container \"" + conf.ContainerName + "\"")
-		return
+		return 0
 	}
 	if containerID == "" {
-
-		images, err := dockerCli.ImageList(context.Background(), types.ImageListOptions{
-			All: true,
-		})
-		ifErr(err, "Error listing docker images", false)
-		foundImage := false
-	mainLoop:
-		for _, image := range images {
-			for _, label := range image.RepoDigests {
-				if strings.Contains(label, "eleanormally/cpp-memory-debugger:"+selectedTag(releaseInfo, flags)) {
-					foundImage = true
-					break mainLoop
-				}
-			}
-		}
-		if !foundImage {
-			fmt.Print("Pulling cbug docker image...")
-			doImagePull(dockerCli, "eleanormally/cpp-memory-debugger:"+selectedTag(releaseInfo, flags))
-			fmt.Println("Done")
-		}
-
-		fmt.Print("Creating New Docker Container...")
-		platform := specs.Platform{}
-		if selectedTag(releaseInfo, flags) != string(releaseInfo.Tag) {
-			switch selectedTag(releaseInfo, flags) {
-			case string(DTagArm):
-				platform.Architecture = "arm64"
-			case string(DTagX86):
-				platform.Architecture = "amd64"
-			}
-			platform.OS = "linux"
-		}
-
-		cont, err := dockerCli.ContainerCreate(
-			context.Background(),
-			&container.Config{
-				Hostname:        "",
-				Domainname:      "",
-				User:            "",
-				AttachStdin:     true,
-				AttachStdout:    true,
-				AttachStderr:    true,
-				ExposedPorts:    nil,
-				Tty:             true,
-				OpenStdin:       true,
-				StdinOnce:       false,
-				Env:             []string{},
-				Healthcheck:     &container.HealthConfig{},
-				ArgsEscaped:     false,
-				Image:           "eleanormally/cpp-memory-debugger:" + selectedTag(releaseInfo, flags),
-				Volumes:         map[string]struct{}{},
-				WorkingDir:      "/debugger",
-				Entrypoint:      []string{},
-				NetworkDisabled: false,
-				MacAddress:      "",
-				OnBuild:         []string{},
-				Labels:          map[string]string{},
-				StopSignal:      "",
-				StopTimeout:     new(int),
-				Shell:           []string{},
-			},
-			&container.HostConfig{},
-			nil,
-			&platform,
-			conf.ContainerName,
-		)
-		ifErr(err, "\n\nError creating Docker container: ", true)
-		fmt.Print("Done\n\n")
-		containerID = cont.ID
-	}
-	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
-	if err != nil {
-		fmt.Println("Error inspecting Docker container: ", true)
-		return
+		containerID = createContainer(dockerCli, conf, releaseInfo, selectedArch(releaseInfo, flags), false)
+		clearState(conf.ContainerName)
 	}
-	if containerInfo.State.Paused {
-		err = dockerCli.ContainerUnpause(context.Background(), containerID)
-		if err != nil {
-			fmt.Println("Error unpausing Docker container: ", true)
-			return
-		}
-	} else if !containerInfo.State.Running {
-		dockerCli.ContainerStart(context.Background(), containerID, types.ContainerStartOptions{})
+	//--timeout-backtrace attaches gdb to the command
+	if args[0] == "gdb" || args[0] == "debug-server" || args[0] == "dap" || (args[0] == "memcheck" && debugsOnError(args[1:])) || flags.backtrace {
+		containerID = ensureDebuggable(dockerCli, conf, releaseInfo, containerLease, containerID)
 	}
-
-	if flags.pause {
-		defer dockerCli.ContainerPause(context.Background(), containerID)
-	} else if flags.stop {
+	err = startContainer(dockerCli, containerID)
+	ifErr(err, "Error starting Docker container: ", true)
+
+	//limits given as flags only last for this command, but the ones in the
+	//config are kept so that existing containers pick up config changes.
+	//docker limits apply to the whole container, so a command with its own
+	//limits has to have the container to itself until they are put back.
+	limits := conf.Resources.merge(flags.resources)
+	if !flags.resources.empty() {
+		if !containerLease.last() {
+			fmt.Println("Error: --memory, --memory-swap, --cpus and --pids limit the whole container, so they can't be used while other cbug commands or sessions are using \"" + conf.ContainerName + "\". Close them and try again.")
+			os.Exit(1)
+		}
+		restore, err := updateResources(dockerCli, containerID, limits)
+		ifErr(err, "Error setting container resource limits: ", true)
 		defer func() {
-			fmt.Print("Stopping cbug container... ")
-			delay := time.Duration(1) * time.Second
-			dockerCli.ContainerStop(context.Background(), containerID, &delay)
-			fmt.Println("Done")
+			restore()
+			containerLease.share()
 		}()
+	} else if !conf.Resources.empty() {
+		_, err = updateResources(dockerCli, containerID, limits)
+		ifErr(err, "Error setting container resource limits: ", true)
 	}
 
+	defer finishContainer(dockerCli, execLoc, containerLease, conf.ContainerName, containerID, flags)
+
 	switch args[0] {
 	case "clean":
+		defer lockFiles(conf.ContainerName, true)()
 		fmt.Print("Cleaning container... ")
 		err := exec.Command("docker", strings.Split("exec "+conf.ContainerName+" bash /custom/removeAll.sh", " ")...).Run()
 		ifErr(err, "Error cleaning container: ", true)
 		fmt.Println("Done")
 	case "sync":
-		fmt.Print("Syncing files between current directory and cbug... ")
-		err := exec.Command("docker", strings.Split("exec "+conf.ContainerName+" bash /custom/removeAll.sh", " ")...).Run()
-		ifErr(err, "Error cleaning container: ", true)
-		fmt.Println("Done")
-		workdir, err := os.Getwd()
-		ifErr(err, "Error accessing current directory", false)
-		err = exec.Command("docker", "cp", workdir+"/.", conf.ContainerName+":debugger").Run()
-		ifErr(err, "Error copying files to docker container: ", true)
+		defer lockFiles(conf.ContainerName, true)()
+		syncFiles(conf)
+	case "session":
+		runSession(execLoc, conf.ContainerName, args[1:])
+	case "dap":
+		if flags.sync {
+			unlock := lockFiles(conf.ContainerName, true)
+			syncFiles(conf)
+			unlock()
+		}
+		defer lockFiles(conf.ContainerName, false)()
+		runDAP(dockerCli, containerID, conf, flags, dapOut)
 
 	default:
 		if flags.sync {
-			fmt.Print("Syncing files between current directory and cbug... ")
-			err = exec.Command("docker", strings.Split("exec "+conf.ContainerName+" rm -rf -- *", " ")...).Run()
-			ifErr(err, "Error cleaning container: ", true)
-			fmt.Println("Done")
-			workdir, err := os.Getwd()
-			ifErr(err, "Error accessing current directory", false)
-			err = exec.Command("docker", "cp", workdir+"/.", conf.ContainerName+":debugger").Run()
-			ifErr(err, "Error copying files to docker container: ", true)
+			unlock := lockFiles(conf.ContainerName, true)
+			syncFiles(conf)
+			unlock()
 		}
+		defer lockFiles(conf.ContainerName, false)()
 
-		tty := ""
-		if flags.tty {
-			tty = "-t "
+		if args[0] == "attach" {
+			exitCode = attachContainer(conf.ContainerName, flags)
+			break
 		}
 
-		var comArgs = []string{}
-		if args[0] == "attach" {
-			if tty != "" {
-				fmt.Println("tty is not possible when attaching a container. ignoring...")
-			}
-			comArgs = []string{"attach", conf.ContainerName}
-			args = []string{}
-		} else {
-			comArgs = strings.Split("exec -i "+tty+conf.ContainerName, " ")
-			if args[0][0] == '/' {
-				args = append([]string{"bash"}, args...)
-			}
+		var heap heapOptions
+		var profile profileOptions
+		var threads threadsOptions
+		interactive := args[0] == "shell" || args[0] == "gdb" || args[0] == "debug-server" || (args[0] == "memcheck" && debugsOnError(args[1:]))
+		switch args[0] {
+		case "shell":
+			//each shell is a new bash, unlike attach which shares the
+			//container's main one, so exiting it leaves the container running
+			args = append([]string{"bash"}, args[1:]...)
+		case "gdb":
+			args = gdbCommand(conf, flags, args[1:])
+		case "debug-server":
+			args = debugServerCommand(dockerCli, conf, containerID, args[1:])
+		case "memcheck":
+			args = memcheckCommand(conf, args[1:])
+		case "heap":
+			args, heap = heapCommand(args[1:])
+		case "profile":
+			args, profile = profileCommand(args[1:])
+		case "threads":
+			args, threads = threadsCommand(args[1:])
 		}
 
-		command := exec.Command("docker", append(comArgs, args...)...)
-		command.Stdin = os.Stdin
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		err = command.Start()
-		ifErr(err, "Error creating command in container: ", true)
-		waitChan := make(chan error, 1)
-		go func() {
-			waitChan <- command.Wait()
-			close(waitChan)
-		}()
-		signalChan := make(chan os.Signal, 1)
-		signal.Notify(signalChan)
-	Loop:
-		for {
-			select {
-			case sig := <-signalChan:
-				if err := command.Process.Signal(sig); err != nil && err.Error() != "os: process already finished" {
-					fmt.Println("Error sending signal from cbug to container")
-					return
-				}
-			case err := <-waitChan:
-				var waitStatus syscall.WaitStatus
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					waitStatus = exitErr.Sys().(syscall.WaitStatus)
-					os.Exit(waitStatus.ExitStatus())
-				}
-				ifErr(err, "Error during connection between cbug and container: ", true)
-				break Loop
-			}
+		warnIfEmulated(dockerCli, containerID, args[0])
+
+		env, err := execEnv(conf, flags)
+		ifErr(err, "Error: ", true)
+		workdir, err := execWorkdir(conf, flags.workdir)
+		ifErr(err, "Error: ", true)
+		if args[0][0] == '/' {
+			args = append([]string{"bash"}, args...)
+		}
+
+		oomBefore := -1
+		if limits.Memory != "" {
+			oomBefore = oomKillCount(conf.ContainerName)
 		}
-	}
 
+		pidFile, err := newPidFile()
+		ifErr(err, "Error: ", true)
+		opts := execOptions{
+			pidFile:     pidFile,
+			coreDumps:   !interactive && !flags.noCore,
+			cmd:         args,
+			env:         env,
+			workdir:     workdir,
+			tty:         useTty(flags),
+			stdin:       os.Stdin,
+			stdout:      os.Stdout,
+			stderr:      os.Stderr,
+			trackPid:    true,
+			interactive: interactive,
+			timeout:     flags.timeout,
+			backtrace:   flags.backtrace,
+		}
+		usage := resourceUsage{}
+		if flags.stats {
+			opts.usage = &usage
+		}
+		var pathWriters []*pathWriter
+		if root := projectRoot(conf); root != "" && translatePaths(conf, flags, interactive) {
+			pathWriters = []*pathWriter{newPathWriter(os.Stdout, root), newPathWriter(os.Stderr, root)}
+			opts.stdout = pathWriters[0]
+			opts.stderr = pathWriters[1]
+		}
+		exitCode, err = runInteractive(dockerCli, containerID, opts)
+		for _, writer := range pathWriters {
+			writer.Flush()
+		}
+		ifErr(err, "Error during connection between cbug and container: ", true)
+		if flags.stats {
+			printUsage(usage)
+		}
+		if exitSignal(exitCode) == "SIGKILL" {
+			reportKilled(conf.ContainerName, limits, oomBefore)
+		} else if !interactive {
+			//a shell's exit code is just that of the last command run in it
+			reportSignalExit(exitCode)
+		}
+		if opts.coreDumps && crashSignals[exitSignal(exitCode)] {
+			captureCrash(dockerCli, containerID, conf, pidFile, workdir)
+		}
+		if heap.massifFile != "" {
+			reportHeap(conf, heap)
+		}
+		if profile.outFile != "" {
+			reportProfile(conf, profile)
+		}
+		if threads.xmlFile != "" {
+			reportThreads(conf, threads)
+		}
+	}
+	return exitCode
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// crashSignals are the signals that mean a program crashed, rather than
+// being stopped on purpose
+var crashSignals = map[string]bool{
+	"SIGSEGV": true,
+	"SIGABRT": true,
+	"SIGBUS":  true,
+	"SIGFPE":  true,
+}
+
+// findCore looks for the core dump left by a crashed command. Where cores go
+// depends on the kernel's core_pattern, which the container shares with the
+// computer docker runs on. Relative patterns put the core in the command's
+// directory. Cores are told apart from other new files by their elf type,
+// and from older cores by being newer than the command's pid file.
+const findCore = `pattern="$(cat /proc/sys/kernel/core_pattern)"
+case "$pattern" in
+	"|"*) echo "pipe ${pattern#|}"; exit 0 ;;
+	/*) dir="$(dirname "$pattern")" ;;
+	*) dir="$2" ;;
+esac
+core=""
+for f in "$dir"/*; do
+	[ -f "$f" ] && [ "$f" -nt "$1" ] || continue
+	[ "$(od -An -tx1 -j16 -N1 "$f" 2>/dev/null | tr -d ' \n')" = "04" ] || continue
+	[ -z "$core" ] || [ "$f" -nt "$core" ] && core="$f"
+done
+[ -n "$core" ] && echo "core $core"
+true`
+
+var (
+	coreCommandRegex = regexp.MustCompile("Core was generated by `([^' ]+)")
+	frameRegex       = regexp.MustCompile(`(?m)^#(\d+) .* at (\S+):\d+$`)
+)
+
+// crashFrame picks the frame to show locals for, which is the first one in
+// the program's own code rather than a system library
+func crashFrame(backtrace string) int {
+	for _, match := range frameRegex.FindAllStringSubmatch(backtrace, -1) {
+		file := match[2]
+		if strings.HasPrefix(file, "/usr/") || strings.HasPrefix(file, "../") || strings.HasPrefix(file, "./") {
+			continue
+		}
+		frame, _ := strconv.Atoi(match[1])
+		return frame
+	}
+	return 0
+}
+
+// captureCrash explains a crash using the core dump the command left behind.
+// It prints a backtrace and the local variables where the program's code
+// crashed, then saves the core and program to .cbug/crashes on this
+// computer, so they can be looked at again after the container is cleaned.
+func captureCrash(dockerCli *client.Client, containerID string, conf configStruct, pidFile string, workdir string) {
+	var out bytes.Buffer
+	if _, err := runExec(dockerCli, containerID, []string{"sh", "-c", findCore, "cbug", pidFile, workdir}, &out, io.Discard); err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to look for a core dump: "+err.Error())
+		return
+	}
+	kind, location, _ := strings.Cut(strings.TrimSpace(out.String()), " ")
+	switch kind {
+	case "pipe":
+		fmt.Fprintln(os.Stderr, "cbug: no core dump was saved, because the computer docker runs on sends core dumps to "+location+". Setting /proc/sys/kernel/core_pattern to \"core\" on it lets cbug collect them.")
+		return
+	case "core":
+	default:
+		fmt.Fprintln(os.Stderr, "cbug: no core dump was saved by the program")
+		return
+	}
+	core := location
+
+	//the core records the command that crashed, which may be a program
+	//started by the command cbug ran
+	out.Reset()
+	gdbCode, err := runExec(dockerCli, containerID, []string{"gdb", "-batch", "-nx", "-c", core}, &out, &out)
+	if err != nil || gdbCode == 127 {
+		fmt.Fprintln(os.Stderr, "cbug: a core dump was saved to "+core+", but gdb isn't installed in the container to read it")
+		return
+	}
+	binary := ""
+	if match := coreCommandRegex.FindStringSubmatch(out.String()); match != nil {
+		binary = match[1]
+		if !path.IsAbs(binary) {
+			binary = path.Join(workdir, binary)
+		}
+	}
+
+	out.Reset()
+	runExec(dockerCli, containerID, []string{"gdb", "-batch", "-nx", "-ex", "bt", binary, core}, &out, io.Discard)
+	backtrace := out.String()
+	out.Reset()
+	frame := strconv.Itoa(crashFrame(backtrace))
+	runExec(dockerCli, containerID, []string{"gdb", "-batch", "-nx", "-ex", "frame " + frame, "-ex", "info locals", binary, core}, &out, io.Discard)
+	locals := out.String()
+	report := "Backtrace:\n" + backtrace + "\nLocals in frame " + frame + ":\n" + locals
+	fmt.Fprintln(os.Stderr, "cbug: "+report)
+
+	//crashes are saved with the project, named for when they happened
+	saveDir, err := artifactDir(conf, "crashes", time.Now().Format("2006-01-02T15-04-05")+"-"+path.Base(binary))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to save the crash: "+err.Error())
+		return
+	}
+	os.WriteFile(filepath.Join(saveDir, "backtrace.txt"), []byte(report), 0644)
+	//the core would otherwise sit in the project's files
+	if err := moveOut(conf, core, saveDir); err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to copy "+core+" from the container: "+err.Error())
+	}
+	if binary != "" {
+		if err := copyOut(conf, binary, saveDir); err != nil {
+			fmt.Fprintln(os.Stderr, "cbug: unable to copy "+binary+" from the container: "+err.Error())
+		}
+	}
+	fmt.Fprintln(os.Stderr, "cbug: saved the core dump and program to "+saveDir)
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+)
+
+// cbug dap lets editors debug programs in the container. It speaks the Debug
+// Adapter Protocol to the editor over stdin and stdout, and drives gdb's
+// machine interface in the container, translating paths between /debugger
+// and the project on this computer.
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int    `json:"id,omitempty"`
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// dapFrame and dapVariables are what the numbers given to the editor for
+// frames and variables refer to. They are only valid until the program runs
+// again.
+type dapFrame struct {
+	thread string
+	level  string
+}
+
+type dapVariables struct {
+	frame  dapFrame
+	varobj string
+}
+
+type dapServer struct {
+	dockerCli   *client.Client
+	containerID string
+	conf        configStruct
+	flags       flagStruct
+	env         []string
+	workdir     string
+	hostRoot    string
+
+	out   io.Writer
+	outMu sync.Mutex
+	seq   int
+
+	gdb         *gdbMI
+	stopOnEntry bool
+	//breakpoints are the gdb breakpoint numbers set in each file
+	breakpoints map[string][]string
+
+	frames    map[int]dapFrame
+	variables map[int]dapVariables
+	varobjs   []string
+	nextID    int
+
+	//terminated is sent when the program exits, and again when gdb does
+	//otherwise, so it is guarded to only be sent once
+	terminated sync.Once
+}
+
+// runDAP serves the Debug Adapter Protocol until the editor disconnects.
+// Anything else cbug prints has to go to stderr, so out is the real stdout.
+func runDAP(dockerCli *client.Client, containerID string, conf configStruct, flags flagStruct, out io.Writer) {
+	env, err := execEnv(conf, flags)
+	ifErr(err, "Error: ", true)
+	server := &dapServer{
+		dockerCli:   dockerCli,
+		containerID: containerID,
+		conf:        conf,
+		flags:       flags,
+		env:         env,
+		hostRoot:    projectRoot(conf),
+		out:         out,
+		breakpoints: map[string][]string{},
+	}
+	if server.workdir, err = execWorkdir(conf, flags.workdir); err != nil {
+		//editors don't always start cbug in the project, and launch can
+		//give the directory instead
+		server.workdir = containerWorkdir
+	}
+	if server.hostRoot == "" {
+		server.hostRoot, _ = os.Getwd()
+	}
+	server.resetState()
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		request, err := readDAP(reader)
+		if err != nil {
+			return
+		}
+		body, err := server.handle(request)
+		response := map[string]interface{}{
+			"type":        "response",
+			"request_seq": request.Seq,
+			"command":     request.Command,
+			"success":     err == nil,
+		}
+		if err != nil {
+			response["message"] = err.Error()
+		} else if body != nil {
+			response["body"] = body
+		}
+		server.send(response)
+		switch {
+		case err != nil:
+		case request.Command == "launch":
+			server.send(map[string]interface{}{"type": "event", "event": "initialized"})
+		case request.Command == "disconnect" || request.Command == "terminate":
+			return
+		}
+	}
+}
+
+func readDAP(reader *bufio.Reader) (dapRequest, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return dapRequest{}, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if name, value, found := strings.Cut(line, ":"); found && strings.EqualFold(name, "Content-Length") {
+			length, _ = strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	if length < 0 {
+		return dapRequest{}, errors.New("missing Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return dapRequest{}, err
+	}
+	var request dapRequest
+	err := json.Unmarshal(body, &request)
+	return request, err
+}
+
+func (s *dapServer) send(message map[string]interface{}) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.seq++
+	message["seq"] = s.seq
+	body, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *dapServer) event(name string, body map[string]interface{}) {
+	s.send(map[string]interface{}{"type": "event", "event": name, "body": body})
+}
+
+func (s *dapServer) output(category string, text string) {
+	s.event("output", map[string]interface{}{"category": category, "output": text})
+}
+
+// toContainer and toHost translate paths between the project on this
+// computer and /debugger
+func (s *dapServer) toContainer(hostPath string) string {
+	root := s.hostRoot
+	for attempt := 0; attempt < 2; attempt++ {
+		relative, err := filepath.Rel(root, hostPath)
+		if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return path.Join(containerWorkdir, filepath.ToSlash(relative))
+		}
+		//editors may give paths with symlinks (like /tmp on macos) resolved
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		if resolved, err := filepath.EvalSymlinks(hostPath); err == nil {
+			hostPath = resolved
+		}
+	}
+	return hostPath
+}
+
+func (s *dapServer) toHost(containerPath string) string {
+	return hostPath(s.hostRoot, containerPath)
+}
+
+// resetState forgets frames and variables, which have to be looked up again
+// each time the program stops
+func (s *dapServer) resetState() {
+	if s.gdb != nil {
+		for _, varobj := range s.varobjs {
+			s.gdb.command("-var-delete " + varobj)
+		}
+	}
+	s.varobjs = nil
+	s.frames = map[int]dapFrame{}
+	s.variables = map[int]dapVariables{}
+}
+
+func (s *dapServer) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *dapServer) requireGdb() error {
+	if s.gdb == nil {
+		return errors.New("the program hasn't been launched")
+	}
+	return nil
+}
+
+// resume runs a gdb command that makes the program run again
+func (s *dapServer) resume(command string) (interface{}, error) {
+	if err := s.requireGdb(); err != nil {
+		return nil, err
+	}
+	s.resetState()
+	_, err := s.gdb.command(command)
+	return map[string]interface{}{"allThreadsContinued": true}, err
+}
+
+func (s *dapServer) handle(request dapRequest) (interface{}, error) {
+	switch request.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		return nil, s.launch(request.Arguments)
+	case "setBreakpoints":
+		return s.setBreakpoints(request.Arguments)
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []dapBreakpoint{}}, nil
+	case "configurationDone":
+		if err := s.requireGdb(); err != nil {
+			return nil, err
+		}
+		if s.stopOnEntry {
+			_, err := s.gdb.command("-exec-run --start")
+			return nil, err
+		}
+		_, err := s.gdb.command("-exec-run")
+		return nil, err
+	case "threads":
+		return s.threads()
+	case "stackTrace":
+		return s.stackTrace(request.Arguments)
+	case "scopes":
+		return s.scopes(request.Arguments)
+	case "variables":
+		return s.listVariables(request.Arguments)
+	case "evaluate":
+		return s.evaluate(request.Arguments)
+	case "continue":
+		return s.resume("-exec-continue")
+	case "next":
+		return s.resume("-exec-next " + s.threadOption(request.Arguments))
+	case "stepIn":
+		return s.resume("-exec-step " + s.threadOption(request.Arguments))
+	case "stepOut":
+		return s.resume("-exec-finish " + s.threadOption(request.Arguments))
+	case "pause":
+		if err := s.requireGdb(); err != nil {
+			return nil, err
+		}
+		_, err := s.gdb.command("-exec-interrupt")
+		return nil, err
+	case "disconnect", "terminate":
+		if s.gdb != nil {
+			s.gdb.command("-gdb-exit")
+			s.gdb.in.Close()
+		}
+		return nil, nil
+	}
+	return nil, errors.New("unsupported request \"" + request.Command + "\"")
+}
+
+func (s *dapServer) threadOption(arguments json.RawMessage) string {
+	var args struct {
+		ThreadID int `json:"threadId"`
+	}
+	json.Unmarshal(arguments, &args)
+	if args.ThreadID == 0 {
+		return ""
+	}
+	return "--thread " + strconv.Itoa(args.ThreadID)
+}
+
+func (s *dapServer) launch(arguments json.RawMessage) error {
+	var args struct {
+		Program     string   `json:"program"`
+		Args        []string `json:"args"`
+		Cwd         string   `json:"cwd"`
+		StopOnEntry bool     `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return errors.New("launch needs a program")
+	}
+	s.stopOnEntry = args.StopOnEntry
+	workdir := s.workdir
+	if args.Cwd != "" {
+		workdir = s.toContainer(args.Cwd)
+	}
+	program := args.Program
+	if filepath.IsAbs(program) {
+		program = s.toContainer(program)
+	}
+
+	cmd := []string{"gdb", "--interpreter=mi2", "-q", "-nx"}
+	if s.conf.GdbInit != "" {
+		cmd = append(cmd, "-x", copyGdbInit(s.conf))
+	}
+	gdb, err := startGdbMI(s.dockerCli, s.containerID, execOptions{cmd: cmd, env: s.env, workdir: workdir})
+	if err != nil {
+		return err
+	}
+	s.gdb = gdb
+	go s.forwardEvents()
+
+	randomization := "off"
+	if s.flags.noASLR {
+		randomization = "on"
+	}
+	setup := []string{
+		"-gdb-set mi-async on",
+		"-enable-pretty-printing",
+		"-gdb-set disable-randomization " + randomization,
+		"-file-exec-and-symbols " + miQuote(program),
+	}
+	//the program's input is gdb's, which is the protocol, so it gets none
+	programArgs := ""
+	for _, arg := range args.Args {
+		programArgs += " " + miQuote(arg)
+	}
+	setup = append(setup, "-exec-arguments"+programArgs+" < /dev/null")
+	for _, command := range setup {
+		if _, err := s.gdb.command(command); err != nil {
+			return errors.New(command + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// forwardEvents turns what gdb reports on its own into protocol events
+func (s *dapServer) forwardEvents() {
+	for record := range s.gdb.events {
+		switch record.kind {
+		case 0:
+			s.output("stdout", record.text+"\n")
+		case '@':
+			s.output("stdout", record.text)
+		case '~':
+			s.output("console", record.text)
+		case '*':
+			if record.class == "stopped" {
+				s.stopped(record)
+			}
+		}
+	}
+	s.terminate()
+}
+
+// terminate tells the editor the debug session is over
+func (s *dapServer) terminate() {
+	s.terminated.Do(func() {
+		s.event("terminated", map[string]interface{}{})
+	})
+}
+
+func (s *dapServer) stopped(record miRecord) {
+	reason := miString(record.results, "reason")
+	switch reason {
+	case "exited-normally", "exited", "exited-signalled":
+		exitCode, _ := strconv.ParseInt(miString(record.results, "exit-code"), 8, 32)
+		if reason == "exited-signalled" {
+			exitCode = int64(128 + linuxSignalNumber(miString(record.results, "signal-name")))
+		}
+		s.event("exited", map[string]interface{}{"exitCode": exitCode})
+		s.terminate()
+		return
+	}
+
+	body := map[string]interface{}{"allThreadsStopped": true}
+	if thread, err := strconv.Atoi(miString(record.results, "thread-id")); err == nil {
+		body["threadId"] = thread
+	}
+	switch reason {
+	case "breakpoint-hit":
+		body["reason"] = "breakpoint"
+	case "end-stepping-range", "function-finished":
+		body["reason"] = "step"
+	case "signal-received":
+		body["reason"] = "exception"
+		body["text"] = miString(record.results, "signal-name")
+		body["description"] = miString(record.results, "signal-meaning")
+	default:
+		body["reason"] = "pause"
+	}
+	s.event("stopped", body)
+}
+
+func (s *dapServer) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	if err := s.requireGdb(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	file := s.toContainer(args.Source.Path)
+	for _, number := range s.breakpoints[file] {
+		s.gdb.command("-break-delete " + number)
+	}
+	s.breakpoints[file] = nil
+
+	breakpoints := []dapBreakpoint{}
+	for _, wanted := range args.Breakpoints {
+		command := "-break-insert -f"
+		if wanted.Condition != "" {
+			command += " -c " + miQuote(wanted.Condition)
+		}
+		record, err := s.gdb.command(command + " " + miQuote(file+":"+strconv.Itoa(wanted.Line)))
+		if err != nil {
+			breakpoints = append(breakpoints, dapBreakpoint{Line: wanted.Line, Message: err.Error()})
+			continue
+		}
+		breakpoint := record.results["bkpt"]
+		number := miString(breakpoint, "number")
+		s.breakpoints[file] = append(s.breakpoints[file], number)
+		id, _ := strconv.Atoi(number)
+		line, err := strconv.Atoi(miString(breakpoint, "line"))
+		if err != nil {
+			line = wanted.Line
+		}
+		breakpoints = append(breakpoints, dapBreakpoint{
+			ID:       id,
+			Verified: miString(breakpoint, "pending") == "",
+			Line:     line,
+		})
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (s *dapServer) threads() (interface{}, error) {
+	threads := []map[string]interface{}{}
+	if s.gdb == nil {
+		return map[string]interface{}{"threads": threads}, nil
+	}
+	record, err := s.gdb.command("-thread-info")
+	if err != nil {
+		return nil, err
+	}
+	for _, thread := range miList(record.results, "threads") {
+		id, err := strconv.Atoi(miString(thread, "id"))
+		if err != nil {
+			continue
+		}
+		name := miString(thread, "name")
+		if name == "" {
+			name = miString(thread, "target-id")
+		}
+		threads = append(threads, map[string]interface{}{"id": id, "name": name})
+	}
+	return map[string]interface{}{"threads": threads}, nil
+}
+
+func (s *dapServer) stackTrace(arguments json.RawMessage) (interface{}, error) {
+	if err := s.requireGdb(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		ThreadID int `json:"threadId"`
+	}
+	json.Unmarshal(arguments, &args)
+	thread := strconv.Itoa(args.ThreadID)
+	record, err := s.gdb.command("-stack-list-frames --thread " + thread)
+	if err != nil {
+		return nil, err
+	}
+	frames := []map[string]interface{}{}
+	for _, frame := range miList(record.results, "stack") {
+		id := s.newID()
+		s.frames[id] = dapFrame{thread: thread, level: miString(frame, "level")}
+		name := miString(frame, "func")
+		if name == "" {
+			name = miString(frame, "addr")
+		}
+		dapFrame := map[string]interface{}{"id": id, "name": name, "line": 0, "column": 0}
+		file := miString(frame, "fullname")
+		if file == "" {
+			file = miString(frame, "file")
+		}
+		if file != "" {
+			hostFile := s.toHost(file)
+			dapFrame["source"] = dapSource{Name: filepath.Base(hostFile), Path: hostFile}
+			dapFrame["line"], _ = strconv.Atoi(miString(frame, "line"))
+			dapFrame["column"] = 1
+		}
+		frames = append(frames, dapFrame)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+func (s *dapServer) scopes(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	json.Unmarshal(arguments, &args)
+	frame, exists := s.frames[args.FrameID]
+	if !exists {
+		return nil, errors.New("unknown frame")
+	}
+	id := s.newID()
+	s.variables[id] = dapVariables{frame: frame}
+	return map[string]interface{}{"scopes": []map[string]interface{}{
+		{"name": "Locals", "variablesReference": id, "expensive": false},
+	}}, nil
+}
+
+// variable makes a protocol variable from a gdb varobj, giving it a number
+// to expand it by if it has children
+func (s *dapServer) variable(name string, varobj interface{}, frame dapFrame) map[string]interface{} {
+	reference := 0
+	if numchild, _ := strconv.Atoi(miString(varobj, "numchild")); numchild > 0 || miString(varobj, "dynamic") == "1" {
+		reference = s.newID()
+		s.variables[reference] = dapVariables{frame: frame, varobj: miString(varobj, "name")}
+	}
+	return map[string]interface{}{
+		"name":               name,
+		"value":              miString(varobj, "value"),
+		"type":               miString(varobj, "type"),
+		"variablesReference": reference,
+	}
+}
+
+func (s *dapServer) listVariables(arguments json.RawMessage) (interface{}, error) {
+	if err := s.requireGdb(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	json.Unmarshal(arguments, &args)
+	scope, exists := s.variables[args.VariablesReference]
+	if !exists {
+		return nil, errors.New("unknown variables")
+	}
+
+	variables := []map[string]interface{}{}
+	frameOptions := "--thread " + scope.frame.thread + " --frame " + scope.frame.level
+	if scope.varobj != "" {
+		record, err := s.gdb.command("-var-list-children --all-values " + miQuote(scope.varobj))
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range miList(record.results, "children") {
+			variables = append(variables, s.variable(miString(child, "exp"), child, scope.frame))
+		}
+		return map[string]interface{}{"variables": variables}, nil
+	}
+
+	record, err := s.gdb.command("-stack-list-variables " + frameOptions + " --no-values")
+	if err != nil {
+		return nil, err
+	}
+	for _, local := range miList(record.results, "variables") {
+		name := miString(local, "name")
+		//varobjs show structs, classes and containers as expandable
+		varobj, err := s.gdb.command("-var-create " + frameOptions + " - * " + miQuote(name))
+		if err != nil {
+			variables = append(variables, map[string]interface{}{"name": name, "value": err.Error(), "variablesReference": 0})
+			continue
+		}
+		s.varobjs = append(s.varobjs, miString(varobj.results, "name"))
+		variables = append(variables, s.variable(name, varobj.results, scope.frame))
+	}
+	return map[string]interface{}{"variables": variables}, nil
+}
+
+func (s *dapServer) evaluate(arguments json.RawMessage) (interface{}, error) {
+	if err := s.requireGdb(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		Expression string `json:"expression"`
+		FrameID    int    `json:"frameId"`
+	}
+	json.Unmarshal(arguments, &args)
+	command := "-data-evaluate-expression "
+	if frame, exists := s.frames[args.FrameID]; exists {
+		command += "--thread " + frame.thread + " --frame " + frame.level + " "
+	}
+	record, err := s.gdb.command(command + miQuote(args.Expression))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"result": miString(record.results, "value"), "variablesReference": 0}, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "pass"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+)
+
+type doctorCheck struct {
+	Name    string      `json:"name"`
+	Status  checkStatus `json:"status"`
+	Message string      `json:"message"`
+	Hint    string      `json:"hint,omitempty"`
+}
+
+type doctorReport struct {
+	Checks []doctorCheck `json:"checks"`
+}
+
+func (r *doctorReport) add(name string, status checkStatus, message string, hint string) {
+	r.Checks = append(r.Checks, doctorCheck{
+		Name:    name,
+		Status:  status,
+		Message: message,
+		Hint:    hint,
+	})
+}
+
+func (r doctorReport) failed() bool {
+	for _, check := range r.Checks {
+		if check.Status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// runDoctor checks everything cbug depends on and prints what it finds. It
+// never exits early, so that one broken piece doesn't hide the others.
+func runDoctor(execLoc string, conf configStruct, releaseInfo infoStruct, releaseErr error, flags flagStruct, args []string) {
+	asJson := false
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--json":
+			asJson = true
+		default:
+			fmt.Println("Unknown doctor option \"" + arg + "\"")
+			os.Exit(1)
+		}
+	}
+
+	report := doctorReport{}
+	checkConfigFile(&report, configPath(execLoc))
+	if releaseErr != nil {
+		report.add("release info", checkFail, releaseErr.Error(), "fix or delete release-info.json in the cbug folder, or redownload cbug")
+	} else {
+		report.add("release info", checkPass, "cbug "+releaseInfo.Version+" for "+releaseInfo.Platform+" ("+releaseInfo.arch()+")", "")
+	}
+
+	dockerCli, err := client.NewEnvClient()
+	if err == nil {
+		err = checkDocker(&report, dockerCli)
+	} else {
+		report.add("docker", checkFail, "unable to create a docker client: "+err.Error(), "check the DOCKER_HOST environment variable")
+	}
+	if err == nil {
+		checkDisk(&report, dockerCli)
+		arch := selectedArch(releaseInfo, flags)
+		checkImage(&report, dockerCli, conf, arch)
+		checkEmulation(&report, dockerCli, arch)
+		checkContainerName(&report, dockerCli, conf)
+	}
+
+	if asJson {
+		out, err := json.MarshalIndent(report, "", "  ")
+		ifErr(err, "Error encoding doctor report: ", true)
+		fmt.Println(string(out))
+	} else {
+		for _, check := range report.Checks {
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Message)
+			if check.Hint != "" {
+				fmt.Println("       -> " + check.Hint)
+			}
+		}
+	}
+	if report.failed() {
+		os.Exit(1)
+	}
+}
+
+func checkConfigFile(report *doctorReport, path string) {
+	confFile, err := os.ReadFile(path)
+	//cbug writes a default config before running doctor, so a missing one
+	//means it couldn't be written
+	if errors.Is(err, os.ErrNotExist) {
+		report.add("config", checkFail, "no config file at "+path+", and cbug was unable to create one", "check the permissions of the folder it is in")
+		return
+	}
+	if err != nil {
+		report.add("config", checkFail, "unable to read "+path+": "+err.Error(), "check the permissions of the folder it is in")
+		return
+	}
+	conf := configStruct{}
+	if err = json.Unmarshal(confFile, &conf); err != nil {
+		report.add("config", checkFail, "config file is not valid json: "+err.Error(), "run \"cbug config default\" to reset it")
+		return
+	}
+	if conf.ContainerName == "" {
+		report.add("config", checkFail, "no container name is configured", "run \"cbug config\" to set one")
+		return
+	}
+	switch {
+	case strings.HasPrefix(conf.DefaultBehaviour, "idle:"):
+		if _, err := parseIdle(strings.TrimPrefix(conf.DefaultBehaviour, "idle:")); err != nil {
+			report.add("config", checkFail, "exit behaviour: "+err.Error(), "run \"cbug config\" to set one")
+			return
+		}
+	case conf.DefaultBehaviour == "shutdown", conf.DefaultBehaviour == "pause", conf.DefaultBehaviour == "keep-alive", conf.DefaultBehaviour == "":
+	default:
+		report.add("config", checkWarn, "unknown exit behaviour \""+conf.DefaultBehaviour+"\", shutdown will be used", "run \"cbug config\" to set one")
+		return
+	}
+	report.add("config", checkPass, "container \""+conf.ContainerName+"\"", "")
+}
+
+// checkDisk checks the free space where docker keeps images and containers.
+// That is on the computer docker runs on, which on macos and with Docker
+// Desktop is a virtual machine whose disk can't be seen from here, so then
+// how much docker is using is reported instead.
+func checkDisk(report *doctorReport, dockerCli *client.Client) {
+	info, err := dockerCli.Info(context.Background())
+	if err != nil {
+		report.add("disk space", checkWarn, "unable to get docker's data folder: "+err.Error(), "")
+		return
+	}
+	stat := syscall.Statfs_t{}
+	local := strings.HasPrefix(dockerCli.DaemonHost(), "unix://") && !strings.Contains(info.OperatingSystem, "Docker Desktop")
+	if local && info.DockerRootDir != "" && syscall.Statfs(info.DockerRootDir, &stat) == nil {
+		free := stat.Bavail * uint64(stat.Bsize)
+		message := fmt.Sprintf("%.1fGB free in %s", float64(free)/(1<<30), info.DockerRootDir)
+		switch {
+		case free < 100<<20:
+			report.add("disk space", checkFail, message, "free up disk space, docker needs room for images and containers")
+		case free < 1<<30:
+			report.add("disk space", checkWarn, message, "free up disk space, docker needs room for images and containers")
+		default:
+			report.add("disk space", checkPass, message, "")
+		}
+		return
+	}
+
+	usage, err := dockerCli.DiskUsage(context.Background())
+	if err != nil {
+		report.add("disk space", checkWarn, "unable to get docker's disk usage: "+err.Error(), "")
+		return
+	}
+	var containers, buildCache int64
+	for _, container := range usage.Containers {
+		containers += container.SizeRw
+	}
+	for _, cache := range usage.BuildCache {
+		buildCache += cache.Size
+	}
+	report.add("disk space", checkPass, "docker is using "+units.BytesSize(float64(usage.LayersSize))+" for images, "+
+		units.BytesSize(float64(containers))+" for containers and "+units.BytesSize(float64(buildCache))+" for build cache. "+
+		"Free space in docker's virtual machine can't be checked from here", "")
+}
+
+func checkDocker(report *doctorReport, dockerCli *client.Client) error {
+	ping, err := dockerCli.Ping(context.Background())
+	if err != nil {
+		report.add("docker", checkFail, "unable to reach the docker daemon: "+err.Error(), "make sure docker is installed and running")
+		return err
+	}
+	serverVersion, err := dockerCli.ServerVersion(context.Background())
+	if err != nil {
+		report.add("docker", checkWarn, "connected (API "+ping.APIVersion+") but unable to get the engine version: "+err.Error(), "")
+		return nil
+	}
+	report.add("docker", checkPass, "engine "+serverVersion.Version+", API "+ping.APIVersion+" on "+serverVersion.Os+"/"+serverVersion.Arch, "")
+	return nil
+}
+
+func checkImage(report *doctorReport, dockerCli *client.Client, conf configStruct, arch string) {
+	image, err := resolveImage(dockerCli, conf, arch)
+	if err != nil {
+		report.add("image", checkFail, err.Error(), "use a different architecture, or set imageName in the config to an image that supports "+arch)
+		return
+	}
+	if imageHasArch(dockerCli, image, arch) {
+		report.add("image", checkPass, image+" is downloaded for "+arch, "")
+		return
+	}
+	report.add("image", checkWarn, image+" is not downloaded for "+arch, "it will be pulled the first time a container is created")
+}
+
+func checkEmulation(report *doctorReport, dockerCli *client.Client, arch string) {
+	if supported, reason := emulationSupport(dockerCli, arch); supported {
+		report.add("emulation", checkPass, arch+" containers are "+reason, "")
+	} else {
+		report.add("emulation", checkFail, arch+" containers can not run: "+reason, emulationHint)
+	}
+}
+
+func checkContainerName(report *doctorReport, dockerCli *client.Client, conf configStruct) {
+	name := conf.ContainerName
+	containers, err := dockerCli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		report.add("container", checkFail, "unable to list docker containers: "+err.Error(), "")
+		return
+	}
+	for _, dContainer := range containers {
+		for _, containerName := range dContainer.Names {
+			if containerName != "/"+name {
+				continue
+			}
+			if !isCbugContainer(conf, dContainer) {
+				report.add("container", checkFail, "a container named \""+name+"\" exists but was not made by cbug", "rename or remove it, or use \"cbug config\" to change cbug's container name")
+				return
+			}
+			report.add("container", checkPass, "\""+name+"\" is "+dContainer.State+" ("+dContainer.Image+")", "")
+			return
+		}
+	}
+	report.add("container", checkPass, "\""+name+"\" does not exist yet and will be created when needed", "")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// normalizeArch turns the different names the kernel, docker and go use for
+// the same architecture into the ones docker uses for platforms
+func normalizeArch(arch string) string {
+	switch arch {
+	case "x86_64", "x86-64", "x86", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	}
+	return arch
+}
+
+// parseArch reads an architecture given to --arch. For users, arm means
+// arm64 like -a does, but docker uses arm for 32 bit arm, so normalizeArch
+// can't treat them as the same.
+func parseArch(arch string) string {
+	if arch == "arm" {
+		return "arm64"
+	}
+	return normalizeArch(arch)
+}
+
+// qemuArch is the name qemu uses for an architecture, which is also what the
+// binfmt handlers are registered as
+func qemuArch(arch string) string {
+	switch arch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return arch
+}
+
+// emulationSupport checks whether docker can run containers built for arch.
+// The reason is meant to be shown to the user either way.
+func emulationSupport(dockerCli *client.Client, arch string) (bool, string) {
+	arch = normalizeArch(arch)
+	info, err := dockerCli.Info(context.Background())
+	if err != nil {
+		return false, "could not get docker info: " + err.Error()
+	}
+	if normalizeArch(info.Architecture) == arch {
+		return true, "native"
+	}
+	if runtime.GOOS == "darwin" || strings.Contains(info.OperatingSystem, "Docker Desktop") {
+		return true, "emulated by Docker Desktop"
+	}
+	if runtime.GOOS != "linux" {
+		return false, "unable to check for emulation support on " + runtime.GOOS
+	}
+
+	handlers, err := filepath.Glob("/proc/sys/fs/binfmt_misc/*")
+	if err != nil || len(handlers) == 0 {
+		return false, "binfmt_misc is not mounted, so no emulators are registered"
+	}
+	for _, handler := range handlers {
+		name := filepath.Base(handler)
+		if name != "qemu-"+qemuArch(arch) && !(arch == "amd64" && name == "rosetta") {
+			continue
+		}
+		contents, err := os.ReadFile(handler)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(string(contents), "enabled") {
+			return true, "emulated by " + name
+		}
+		return false, "the " + name + " emulator is registered but disabled"
+	}
+	return false, "no emulator for " + qemuArch(arch) + " is registered with binfmt_misc"
+}
+
+// emulationHint is what to tell the user when emulation is not available
+const emulationHint = "install emulators with \"docker run --privileged --rm tonistiigi/binfmt --install all\""
+
+// containerArch looks up the architecture of the image a container was made from
+func containerArch(dockerCli *client.Client, containerID string) (string, error) {
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return "", err
+	}
+	imageInfo, _, err := dockerCli.ImageInspectWithRaw(context.Background(), containerInfo.Image)
+	if err != nil {
+		return "", err
+	}
+	return normalizeArch(imageInfo.Architecture), nil
+}
+
+// isEmulated reports whether docker has to emulate arch instead of running it natively
+func isEmulated(dockerCli *client.Client, arch string) bool {
+	info, err := dockerCli.Info(context.Background())
+	if err != nil {
+		return false
+	}
+	return normalizeArch(info.Architecture) != normalizeArch(arch)
+}
+
+// emulationWarnings are the memory checkers known to misbehave under qemu
+// user emulation, and what to tell the user to do instead
+var emulationWarnings = map[string]string{
+	"valgrind": "valgrind often crashes or reports errors that aren't there when emulated. " +
+		"Use a container for this computer's architecture, or compile with -fsanitize=address instead.",
+	"drmemory": "Dr. Memory does not support emulated environments. " +
+		"Use a container for this computer's architecture, or use valgrind or -fsanitize=address instead.",
+}
+
+// warnIfEmulated prints a warning if command is a checker that doesn't work
+// well under emulation and the container is emulated
+func warnIfEmulated(dockerCli *client.Client, containerID string, command string) {
+	warning, ok := emulationWarnings[filepath.Base(command)]
+	if !ok {
+		return
+	}
+	arch, err := containerArch(dockerCli, containerID)
+	if err != nil || !isEmulated(dockerCli, arch) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Warning: this container is running "+arch+" through emulation. "+warning)
+}
+
+// printContainerInfo shows which architecture the container runs and whether
+// it is emulated. Docker not running isn't an error here, since info is
+// still useful without it.
+func printContainerInfo(conf configStruct) {
+	containerName := conf.ContainerName
+	dockerCli, err := client.NewEnvClient()
+	if err != nil {
+		return
+	}
+	containers, err := dockerCli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		fmt.Println("container: unable to connect to docker")
+		return
+	}
+	for _, dContainer := range containers {
+		for _, name := range dContainer.Names {
+			if name != "/"+containerName || !isCbugContainer(conf, dContainer) {
+				continue
+			}
+			arch, err := containerArch(dockerCli, dContainer.ID)
+			if err != nil {
+				fmt.Println("container: unable to inspect \"" + containerName + "\": " + err.Error())
+				return
+			}
+			mode := "natively"
+			if isEmulated(dockerCli, arch) {
+				mode = "through emulation"
+			}
+			fmt.Println("container: \"" + containerName + "\" is " + dContainer.State + ", running " + arch + " " + mode)
+			return
+		}
+	}
+	fmt.Println("container: \"" + containerName + "\" has not been created")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// environment keeps variables in the order they were first set, so that the
+// command sees them the way they were written, while letting later sources
+// replace earlier values
+type environment struct {
+	keys   []string
+	values map[string]string
+}
+
+func (e *environment) set(key string, value string) {
+	if e.values == nil {
+		e.values = map[string]string{}
+	}
+	if _, exists := e.values[key]; !exists {
+		e.keys = append(e.keys, key)
+	}
+	e.values[key] = value
+}
+
+// setEntry handles KEY=VAL, or just KEY to pass the host's value through
+// like docker does. A KEY that isn't set on the host is left out.
+func (e *environment) setEntry(entry string) error {
+	key, value, hasValue := strings.Cut(entry, "=")
+	if key == "" {
+		return errors.New("invalid environment variable \"" + entry + "\"")
+	}
+	if !hasValue {
+		var set bool
+		if value, set = os.LookupEnv(key); !set {
+			return nil
+		}
+	}
+	e.set(key, value)
+	return nil
+}
+
+func (e environment) list() []string {
+	list := []string{}
+	for _, key := range e.keys {
+		list = append(list, key+"="+e.values[key])
+	}
+	return list
+}
+
+// execEnv collects the environment for commands run in the container. The
+// config comes first, then env files, then -e flags, so the most specific
+// source wins.
+func execEnv(conf configStruct, flags flagStruct) ([]string, error) {
+	env := environment{}
+	for _, key := range conf.PassEnv {
+		if err := env.setEntry(key); err != nil {
+			return nil, err
+		}
+	}
+	keys := []string{}
+	for key := range conf.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env.set(key, conf.Env[key])
+	}
+	for _, file := range flags.envFiles {
+		if err := readEnvFile(&env, file); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range flags.env {
+		if err := env.setEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return env.list(), nil
+}
+
+// readEnvFile reads a file of KEY=VAL lines, the same format docker's
+// --env-file uses. Blank lines and lines starting with # are skipped.
+func readEnvFile(env *environment, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.New("unable to open env file: " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := env.setEntry(line); err != nil {
+			return errors.New(path + " line " + strconv.Itoa(lineNumber) + ": " + err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// envArgs turns an environment list into docker exec flags
+func envArgs(env []string) []string {
+	args := []string{}
+	for _, entry := range env {
+		args = append(args, "-e", entry)
+	}
+	return args
+}
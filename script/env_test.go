@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	t.Setenv("CBUG_TEST_HOST", "from host")
+	//t.Setenv puts back whatever was there before the test
+	t.Setenv("CBUG_TEST_UNSET", "")
+	os.Unsetenv("CBUG_TEST_UNSET")
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+		wantErr  bool
+	}{
+		{"values", "A=1\nB=two words\n", []string{"A=1", "B=two words"}, false},
+		{"comments and blank lines", "# comment\n\nA=1\n   \n  # indented comment\n", []string{"A=1"}, false},
+		{"spaces around lines", "  A=1  \n", []string{"A=1"}, false},
+		{"empty value", "A=\n", []string{"A="}, false},
+		{"value with equals", "A=b=c\n", []string{"A=b=c"}, false},
+		{"later value wins", "A=1\nB=2\nA=3\n", []string{"A=3", "B=2"}, false},
+		{"host value", "CBUG_TEST_HOST\n", []string{"CBUG_TEST_HOST=from host"}, false},
+		{"unset host value", "CBUG_TEST_UNSET\nA=1\n", []string{"A=1"}, false},
+		{"no trailing newline", "A=1", []string{"A=1"}, false},
+		{"missing key", "A=1\n=2\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "env")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			env := environment{}
+			err := readEnvFile(&env, path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("readEnvFile() = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readEnvFile() = %v", err)
+			}
+			if got := env.list(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readEnvFile() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadEnvFileMissing(t *testing.T) {
+	env := environment{}
+	if err := readEnvFile(&env, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("readEnvFile() = nil, want an error for a missing file")
+	}
+}
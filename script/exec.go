@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/moby/term"
+)
+
+// execOptions describes a command to run in a container
+type execOptions struct {
+	cmd     []string
+	env     []string
+	workdir string
+	tty     bool
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	//trackPid records the command's pid in the container so that signals
+	//can be sent to it
+	trackPid bool
+	//pidFile is where the pid is written. One is made up if it is empty.
+	pidFile string
+	//coreDumps lets the command write a core dump if it crashes
+	coreDumps bool
+	//interactive is set for shells and debuggers, which handle ctrl-c
+	//themselves, so pressing it repeatedly doesn't kill them
+	interactive bool
+	//timeout kills the command if it runs for longer, and backtrace prints
+	//where its threads were first
+	timeout   time.Duration
+	backtrace bool
+	//usage is filled in with the command's resource usage if it isn't nil
+	usage *resourceUsage
+}
+
+// timeoutExitCode is what cbug exits with when a command times out, the same
+// as the timeout command uses
+const timeoutExitCode = 124
+
+// execSession is a command running in a container through the docker api.
+// done receives once all of its output has been copied.
+type execSession struct {
+	dockerCli   *client.Client
+	containerID string
+	id          string
+	conn        types.HijackedResponse
+	done        chan error
+	pidFile     string
+	//interrupts receives whenever ctrl-c is typed into a tty
+	interrupts chan struct{}
+	//killed is set once repeated ctrl-c made cbug kill the command
+	killed bool
+	//timedOut is set once the command was killed for taking too long
+	timedOut bool
+}
+
+// pidDir holds the pid of every tracked command in a container
+const pidDir = "/tmp/cbug"
+
+// pidWrapper starts a command after writing its pid to a file. exec keeps
+// the pid the same, and files left by commands that have exited are cleaned
+// up each time, since nothing runs after the command to remove its own.
+const pidWrapper = `mkdir -p ` + pidDir + `
+for f in ` + pidDir + `/*.pid; do
+	[ -e "$f" ] && ! kill -0 "$(cat "$f")" 2>/dev/null && rm -f "$f"
+done
+echo $$ > "$CBUG_PID_FILE"
+unset CBUG_PID_FILE
+exec "$@"`
+
+// newPidFile makes up a name for a command's pid file
+func newPidFile() (string, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return pidDir + "/" + hex.EncodeToString(token) + ".pid", nil
+}
+
+func startExec(dockerCli *client.Client, containerID string, opts execOptions) (*execSession, error) {
+	session := &execSession{
+		dockerCli:   dockerCli,
+		containerID: containerID,
+		done:        make(chan error, 1),
+		interrupts:  make(chan struct{}, 1),
+	}
+	cmd, env := opts.cmd, opts.env
+	if opts.trackPid {
+		session.pidFile = opts.pidFile
+		if session.pidFile == "" {
+			var err error
+			if session.pidFile, err = newPidFile(); err != nil {
+				return nil, err
+			}
+		}
+		wrapper := pidWrapper
+		if opts.coreDumps {
+			//the hard limit may not allow unlimited
+			wrapper = `ulimit -c unlimited 2>/dev/null || ulimit -c "$(ulimit -Hc)" 2>/dev/null` + "\n" + wrapper
+		}
+		cmd = append([]string{"sh", "-c", wrapper, "cbug"}, cmd...)
+		env = append(append([]string{}, env...), "CBUG_PID_FILE="+session.pidFile)
+	}
+
+	created, err := dockerCli.ContainerExecCreate(context.Background(), containerID, types.ExecConfig{
+		Tty:          opts.tty,
+		AttachStdin:  opts.stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          env,
+		WorkingDir:   opts.workdir,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dockerCli.ContainerExecAttach(context.Background(), created.ID, types.ExecStartCheck{Tty: opts.tty})
+	if err != nil {
+		return nil, err
+	}
+
+	session.id, session.conn = created.ID, conn
+	if opts.stdin != nil {
+		stdin := opts.stdin
+		if opts.tty {
+			stdin = interruptReader{stdin, session.interrupts}
+		}
+		go func() {
+			io.Copy(conn.Conn, stdin)
+			conn.CloseWrite()
+		}()
+	}
+	go func() {
+		var err error
+		if opts.tty {
+			_, err = io.Copy(opts.stdout, conn.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(opts.stdout, opts.stderr, conn.Reader)
+		}
+		session.done <- err
+	}()
+	return session, nil
+}
+
+// interruptReader reports ctrl-c typed into a tty. The tty turns it into a
+// SIGINT for the program, so cbug only watches it to notice a program that
+// won't stop.
+type interruptReader struct {
+	in         io.Reader
+	interrupts chan struct{}
+}
+
+func (r interruptReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	for _, b := range p[:n] {
+		if b == 0x03 {
+			select {
+			case r.interrupts <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return n, err
+}
+
+// signal sends a signal, by name, to the command in the container. This only
+// works for commands started with trackPid.
+func (s *execSession) signal(name string) error {
+	if s.pidFile == "" {
+		return errors.New("the command's pid is not known")
+	}
+	created, err := s.dockerCli.ContainerExecCreate(context.Background(), s.containerID, types.ExecConfig{
+		Cmd: []string{"sh", "-c", `kill -s ` + strings.TrimPrefix(name, "SIG") + ` "$(cat "$1")"`, "cbug", s.pidFile},
+	})
+	if err != nil {
+		return err
+	}
+	return s.dockerCli.ContainerExecStart(context.Background(), created.ID, types.ExecStartCheck{Detach: true})
+}
+
+// killTree kills the command along with every process it started. The
+// processes are stopped first so that none can start more while they are
+// being found.
+func (s *execSession) killTree() error {
+	if s.pidFile == "" {
+		return errors.New("the command's pid is not known")
+	}
+	script := `tree() {
+	echo "$1"
+	for child in $(cat /proc/"$1"/task/*/children 2>/dev/null); do tree "$child"; done
+}
+root="$(cat "$1")"
+kill -s STOP $(tree "$root") 2>/dev/null
+kill -s KILL $(tree "$root") 2>/dev/null
+true`
+	_, err := runExec(s.dockerCli, s.containerID, []string{"sh", "-c", script, "cbug", s.pidFile}, io.Discard, io.Discard)
+	return err
+}
+
+// printBacktrace attaches gdb to the command to print a backtrace of all of
+// its threads
+func (s *execSession) printBacktrace(out io.Writer) error {
+	if s.pidFile == "" {
+		return errors.New("the command's pid is not known")
+	}
+	cmd := []string{"sh", "-c", `exec gdb -p "$(cat "$1")" -batch -nx -ex "thread apply all bt"`, "cbug", s.pidFile}
+	_, err := runExec(s.dockerCli, s.containerID, cmd, out, out)
+	return err
+}
+
+// runExec runs a command in a container without input and waits for it
+func runExec(dockerCli *client.Client, containerID string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	session, err := startExec(dockerCli, containerID, execOptions{cmd: cmd, stdout: stdout, stderr: stderr})
+	if err != nil {
+		return 0, err
+	}
+	if err := <-session.done; err != nil {
+		return 0, err
+	}
+	return session.exitCode()
+}
+
+// resize sets the exec's tty to the size of the terminal fd
+func (s *execSession) resize(fd uintptr) error {
+	size, err := term.GetWinsize(fd)
+	if err != nil {
+		return err
+	}
+	return s.dockerCli.ContainerExecResize(context.Background(), s.id, types.ResizeOptions{
+		Height: uint(size.Height),
+		Width:  uint(size.Width),
+	})
+}
+
+// exitCode waits for the exec to finish after its output has ended, and
+// returns the status it exited with
+func (s *execSession) exitCode() (int, error) {
+	s.conn.Close()
+	for {
+		inspect, err := s.dockerCli.ContainerExecInspect(context.Background(), s.id)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// useTty decides whether to give the command a tty. Without a flag forcing
+// it either way, this follows whether cbug itself is attached to a terminal,
+// since a tty breaks input redirected from a file but programs reading from
+// the keyboard need one.
+func useTty(flags flagStruct) bool {
+	if flags.tty || flags.noTty {
+		return flags.tty
+	}
+	return term.IsTerminal(os.Stdin.Fd()) && term.IsTerminal(os.Stdout.Fd())
+}
+
+// runInteractive runs a command connected to cbug's terminal and returns its
+// exit code. With a tty, the local terminal is put in raw mode so that keys
+// like ctrl-c reach the program, and changes to the window size are passed
+// on so that full screen programs draw correctly.
+func runInteractive(dockerCli *client.Client, containerID string, opts execOptions) (int, error) {
+	session, err := startExec(dockerCli, containerID, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	resizeChan := make(chan os.Signal, 1)
+	restoreTerminal := func() {}
+	if opts.tty && term.IsTerminal(os.Stdin.Fd()) {
+		state, err := term.SetRawTerminal(os.Stdin.Fd())
+		if err == nil {
+			restoreTerminal = func() { term.RestoreTerminal(os.Stdin.Fd(), state) }
+			defer restoreTerminal()
+		}
+	}
+	if opts.tty && term.IsTerminal(os.Stdout.Fd()) {
+		session.resize(os.Stdout.Fd())
+		signal.Notify(resizeChan, syscall.SIGWINCH)
+		defer signal.Stop(resizeChan)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, forwardedSignals...)
+	defer signal.Stop(signalChan)
+	started := time.Now()
+	var samples <-chan resourceUsage
+	if opts.usage != nil && session.pidFile != "" {
+		samples = sampleUsage(session)
+	}
+
+	var timeout <-chan time.Time
+	if opts.timeout > 0 {
+		timer := time.NewTimer(opts.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var interrupted []time.Time
+	for {
+		select {
+		case <-resizeChan:
+			session.resize(os.Stdout.Fd())
+		case sig := <-signalChan:
+			//in a raw tty ctrl-c doesn't signal cbug, so this came from
+			//somewhere else and still needs to reach the program
+			if sig == syscall.SIGINT && !opts.interactive {
+				interrupted = session.interrupt(interrupted)
+			}
+			if err := session.signal(signalName(sig)); err != nil {
+				fmt.Fprintln(os.Stderr, "cbug: unable to send "+signalName(sig)+" to the command: "+err.Error())
+			}
+		case <-session.interrupts:
+			if !opts.interactive {
+				interrupted = session.interrupt(interrupted)
+			}
+		case <-timeout:
+			//the program's output is finished with, so the terminal can go
+			//back to normal for cbug's own messages
+			restoreTerminal()
+			session.timedOut = true
+			fmt.Fprintln(os.Stderr, "\ncbug: the program timed out after "+opts.timeout.String())
+			if opts.backtrace {
+				if err := session.printBacktrace(os.Stderr); err != nil {
+					fmt.Fprintln(os.Stderr, "cbug: unable to get a backtrace: "+err.Error())
+				}
+			}
+			if err := session.killTree(); err != nil {
+				fmt.Fprintln(os.Stderr, "cbug: unable to kill the program: "+err.Error())
+			}
+		case err := <-session.done:
+			if err != nil {
+				return 0, err
+			}
+			exitCode, err := session.exitCode()
+			if opts.usage != nil {
+				if samples != nil {
+					*opts.usage = <-samples
+				}
+				opts.usage.wall = time.Since(started)
+			}
+			if session.timedOut {
+				return timeoutExitCode, err
+			}
+			if session.killed && exitCode == 128+9 {
+				//the user asked for it to stop, so this is reported like any
+				//other ctrl-c rather than as something killing the program
+				exitCode = 128 + 2
+			}
+			return exitCode, err
+		}
+	}
+}
+
+// interruptWindow is how close together ctrl-c presses have to be to count as
+// trying to stop a program that isn't responding
+const interruptWindow = 2 * time.Second
+
+// interrupt keeps track of ctrl-c presses. A program can catch SIGINT, so if
+// ctrl-c is pressed three times in quick succession the program is killed.
+func (s *execSession) interrupt(previous []time.Time) []time.Time {
+	now := time.Now()
+	recent := []time.Time{}
+	for _, at := range previous {
+		if now.Sub(at) < interruptWindow {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	switch len(recent) {
+	case 2:
+		fmt.Fprintln(os.Stderr, "\r\ncbug: press ctrl-c again to kill the program\r")
+	case 3:
+		s.killed = true
+		if err := s.signal("SIGKILL"); err != nil {
+			fmt.Fprintln(os.Stderr, "\r\ncbug: unable to kill the command: "+err.Error()+"\r")
+		}
+		return nil
+	}
+	return recent
+}
+
+// reportSignalExit explains an exit code that came from a signal, since 139
+// or 134 on their own don't say much. SIGKILL has its own report, which
+// checks for running out of memory.
+func reportSignalExit(exitCode int) {
+	name := exitSignal(exitCode)
+	//like a shell, stay quiet about the signals that are expected
+	if name == "" || name == "SIGINT" || name == "SIGPIPE" {
+		return
+	}
+	message := "cbug: the program was terminated by " + name
+	if description, exists := signalDescriptions[name]; exists {
+		message += " (" + description + ")"
+	}
+	fmt.Fprintln(os.Stderr, message)
+}
+
+// attachContainer connects the terminal to the container's main shell
+func attachContainer(containerName string, flags flagStruct) int {
+	if flags.tty {
+		fmt.Println("tty is not possible when attaching a container. ignoring...")
+	}
+	command := exec.Command("docker", "attach", containerName)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	err := command.Start()
+	ifErr(err, "Error creating command in container: ", true)
+	waitChan := make(chan error, 1)
+	go func() {
+		waitChan <- command.Wait()
+		close(waitChan)
+	}()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, forwardedSignals...)
+	for {
+		select {
+		case sig := <-signalChan:
+			if err := command.Process.Signal(sig); err != nil && err.Error() != "os: process already finished" {
+				fmt.Println("Error sending signal from cbug to container")
+				return 1
+			}
+		case err := <-waitChan:
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+			}
+			ifErr(err, "Error during connection between cbug and container: ", true)
+			return 0
+		}
+	}
+}
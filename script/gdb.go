@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// debugCapabilities are given to containers that debuggers are used in, so
+// that they can use ptrace
+var debugCapabilities = []string{"SYS_PTRACE"}
+
+// debugLabel is set on containers created with debugCapabilities and the
+// debug seccomp profile
+const debugLabel = "cbug.debug"
+
+// defaultSeccompProfile is docker's default seccomp profile, from
+// profiles/seccomp/default.json in docker
+//
+//go:embed seccomp-default.json
+var defaultSeccompProfile []byte
+
+// debugSeccompProfile is docker's default seccomp profile, but with
+// personality allowed for any argument, which gdb uses to turn off address
+// space randomization. Everything else docker blocks stays blocked.
+func debugSeccompProfile() string {
+	profile := map[string]interface{}{}
+	err := json.Unmarshal(defaultSeccompProfile, &profile)
+	ifErr(err, "Error reading the seccomp profile: ", true)
+	syscalls, _ := profile["syscalls"].([]interface{})
+	profile["syscalls"] = append(syscalls, map[string]interface{}{
+		"names":  []string{"personality"},
+		"action": "SCMP_ACT_ALLOW",
+	})
+	encoded, err := json.Marshal(profile)
+	ifErr(err, "Error writing the seccomp profile: ", true)
+	return string(encoded)
+}
+
+// debugPort is the port gdbserver listens on in the container
+const debugPort nat.Port = "2345/tcp"
+
+// containerGdbInit is where the gdbinit from the config is copied to
+const containerGdbInit = "/tmp/cbug-gdbinit"
+
+// canDebug reports whether a container was created with what debuggers need.
+// Only containers that a debugger has been used in are.
+func canDebug(containerInfo types.ContainerJSON) bool {
+	return containerInfo.Config != nil && containerInfo.Config.Labels[debugLabel] == "1"
+}
+
+// ensureDebuggable makes sure a container can be used with a debugger,
+// recreating it if it can't. Docker can't change these settings on an
+// existing container, so the files in /debugger are copied out and put back
+// in the new one. Returns the ID of the container to use.
+func ensureDebuggable(dockerCli *client.Client, conf configStruct, releaseInfo infoStruct, containerLease *lease, containerID string) string {
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
+	ifErr(err, "Error inspecting Docker container: ", true)
+	if canDebug(containerInfo) {
+		return containerID
+	}
+	if !containerLease.last() {
+		fmt.Println("Error: the cbug container \"" + conf.ContainerName + "\" was made without debugger support and needs to be recreated, but other cbug commands or sessions are using it. Close them and try again.")
+		os.Exit(1)
+	}
+	defer containerLease.share()
+
+	fmt.Println("Recreating the cbug container to allow debugging. Your files in the container will be kept.")
+	arch, err := containerArch(dockerCli, containerID)
+	ifErr(err, "Error inspecting Docker container: ", true)
+	ifErr(startContainer(dockerCli, containerID), "Error starting Docker container: ", true)
+	backup, err := os.MkdirTemp("", "cbug-")
+	ifErr(err, "Error making a folder for the container's files: ", true)
+	defer os.RemoveAll(backup)
+	err = exec.Command("docker", "cp", conf.ContainerName+":"+containerWorkdir+"/.", backup).Run()
+	ifErr(err, "Error copying files out of the docker container: ", true)
+
+	delay := time.Duration(1) * time.Millisecond
+	dockerCli.ContainerStop(context.Background(), containerID, &delay)
+	err = dockerCli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
+	ifErr(err, "Error removing container: ", true)
+
+	containerID = createContainer(dockerCli, conf, releaseInfo, arch, true)
+	ifErr(startContainer(dockerCli, containerID), "Error starting Docker container: ", true)
+	err = exec.Command("docker", "cp", backup+"/.", conf.ContainerName+":"+containerWorkdir).Run()
+	ifErr(err, "Error copying files to docker container: ", true)
+	return containerID
+}
+
+// copyGdbInit copies the gdbinit from the config into the container and
+// returns where it is there
+func copyGdbInit(conf configStruct) string {
+	gdbInit := conf.GdbInit
+	if strings.HasPrefix(gdbInit, "~/") {
+		home, err := os.UserHomeDir()
+		ifErr(err, "Error finding home directory: ", true)
+		gdbInit = filepath.Join(home, gdbInit[2:])
+	}
+	err := exec.Command("docker", "cp", gdbInit, conf.ContainerName+":"+containerGdbInit).Run()
+	ifErr(err, "Error copying gdbinit \""+gdbInit+"\" to the docker container: ", true)
+	return containerGdbInit
+}
+
+// gdbCommand builds the command for cbug gdb. gdb normally turns off address
+// space randomization, but cbug leaves it on unless --no-aslr is given, so
+// that programs behave the same in gdb as they do when run normally.
+func gdbCommand(conf configStruct, flags flagStruct, args []string) []string {
+	if len(args) == 0 {
+		fmt.Println("Usage: cbug gdb <program> [args]")
+		os.Exit(1)
+	}
+	cmd := []string{"gdb", "-q"}
+	if conf.GdbInit != "" {
+		cmd = append(cmd, "-x", copyGdbInit(conf))
+	}
+	randomization := "off"
+	if flags.noASLR {
+		randomization = "on"
+	}
+	cmd = append(cmd, "-ex", "set disable-randomization "+randomization, "--args")
+	return append(cmd, args...)
+}
+
+// debugServerCommand builds the command for cbug debug-server, which runs a
+// program under gdbserver so that a debugger on this computer can connect.
+// It writes a gdbinit to .cbug in the project that connects to it and maps
+// /debugger back to the project, so breakpoints set in files here work.
+func debugServerCommand(dockerCli *client.Client, conf configStruct, containerID string, args []string) []string {
+	if len(args) == 0 {
+		fmt.Println("Usage: cbug debug-server <program> [args]")
+		os.Exit(1)
+	}
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
+	ifErr(err, "Error inspecting Docker container: ", true)
+	bindings := containerInfo.NetworkSettings.Ports[debugPort]
+	if len(bindings) == 0 {
+		fmt.Println("Error: the debug port of the cbug container isn't published")
+		os.Exit(1)
+	}
+	address := "127.0.0.1:" + bindings[0].HostPort
+
+	root := projectRoot(conf)
+	if root == "" {
+		root, err = os.Getwd()
+		ifErr(err, "Error accessing current directory", false)
+	}
+	gdbInit := filepath.Join(root, ".cbug", "gdbinit")
+	err = os.MkdirAll(filepath.Dir(gdbInit), 0755)
+	if err == nil {
+		err = os.WriteFile(gdbInit, []byte("# written by cbug debug-server\n"+
+			"set substitute-path "+containerWorkdir+" "+root+"\n"+
+			"target remote "+address+"\n"), 0644)
+	}
+	ifErr(err, "Error writing gdbinit: ", true)
+
+	fmt.Println("gdbserver for " + args[0] + " is listening on " + address)
+	fmt.Println("Connect with gdb on this computer using:")
+	fmt.Println("\tgdb -x " + gdbInit)
+	fmt.Println("or point your editor's remote gdb debugging at " + address + ", with " + containerWorkdir + " mapped to " + root)
+	return append([]string{"gdbserver", ":" + debugPort.Port()}, args...)
+}
@@ -1,9 +1,10 @@
-module cppdebug
+module github.com/eleanormally/cbug/script
 
 go 1.19
 
 require (
 	github.com/docker/docker v20.10.23+incompatible
+	github.com/google/pprof v0.0.0-20221118152302-e6195bd50e26
 	github.com/klauspost/cpuid v1.3.1
 	github.com/klauspost/cpuid/v2 v2.2.3
 )
@@ -19,11 +20,11 @@ require (
 require (
 	github.com/Microsoft/go-winio v0.6.0 // indirect
 	github.com/docker/distribution v2.8.1+incompatible // indirect
-	github.com/docker/go-connections v0.4.0 // indirect
-	github.com/docker/go-units v0.5.0 // indirect
+	github.com/docker/go-connections v0.4.0
+	github.com/docker/go-units v0.5.0
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/google/go-github/v50 v50.0.0
-	github.com/moby/term v0.0.0-20221205130635-1aeaba878587 // indirect
+	github.com/moby/term v0.0.0-20221205130635-1aeaba878587
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.0.2
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// heapOptions are the options given to cbug heap
+type heapOptions struct {
+	//massifFile is where massif writes its profile in the container
+	massifFile string
+	html       string
+	svg        string
+}
+
+// heapCommand builds the command for cbug heap, which runs a program under
+// valgrind's massif to record how much heap it uses over time
+func heapCommand(args []string) ([]string, heapOptions) {
+	opts := heapOptions{massifFile: pidDir + "/massif.out." + strconv.FormatInt(time.Now().UnixNano(), 36)}
+	for len(args) > 1 && (args[0] == "--html" || args[0] == "--svg") {
+		if args[0] == "--html" {
+			opts.html = args[1]
+		} else {
+			opts.svg = args[1]
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "--") {
+		fmt.Println("Usage: cbug heap [--html file] [--svg file] <program> [args]")
+		os.Exit(1)
+	}
+	return append([]string{"valgrind", "--tool=massif", "--massif-out-file=" + opts.massifFile}, args...), opts
+}
+
+type massifNode struct {
+	bytes    int64
+	desc     string
+	children []*massifNode
+}
+
+type massifSnapshot struct {
+	time  int64
+	heap  int64
+	extra int64
+	peak  bool
+	tree  *massifNode
+}
+
+func (s massifSnapshot) total() int64 {
+	return s.heap + s.extra
+}
+
+type massifProfile struct {
+	cmd       string
+	timeUnit  string
+	snapshots []massifSnapshot
+}
+
+var massifNodeRegex = regexp.MustCompile(`^( *)n\d+: (\d+) (.*)$`)
+
+// parseMassif reads the output file massif writes. Each snapshot has the
+// heap size at a point in time, and some also have a tree of where the heap
+// was allocated from, indented by depth.
+func parseMassif(r io.Reader) (massifProfile, error) {
+	profile := massifProfile{}
+	var stack []*massifNode
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := massifNodeRegex.FindStringSubmatch(line); match != nil {
+			if len(profile.snapshots) == 0 {
+				continue
+			}
+			bytes, _ := strconv.ParseInt(match[2], 10, 64)
+			node := &massifNode{bytes: bytes, desc: match[3]}
+			depth := len(match[1])
+			snapshot := &profile.snapshots[len(profile.snapshots)-1]
+			if depth == 0 || snapshot.tree == nil {
+				snapshot.tree = node
+				stack = []*massifNode{node}
+				continue
+			}
+			if depth > len(stack) {
+				depth = len(stack)
+			}
+			parent := stack[depth-1]
+			parent.children = append(parent.children, node)
+			stack = append(stack[:depth], node)
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			key, value, found = strings.Cut(line, ": ")
+			if !found {
+				continue
+			}
+		}
+		var snapshot *massifSnapshot
+		if len(profile.snapshots) > 0 {
+			snapshot = &profile.snapshots[len(profile.snapshots)-1]
+		}
+		number, _ := strconv.ParseInt(value, 10, 64)
+		switch {
+		case key == "cmd":
+			profile.cmd = value
+		case key == "time_unit":
+			profile.timeUnit = value
+		case key == "snapshot":
+			profile.snapshots = append(profile.snapshots, massifSnapshot{})
+		case snapshot == nil:
+		case key == "time":
+			snapshot.time = number
+		case key == "mem_heap_B":
+			snapshot.heap = number
+		case key == "mem_heap_extra_B":
+			snapshot.extra = number
+		case key == "heap_tree":
+			snapshot.peak = value == "peak"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return profile, err
+	}
+	if len(profile.snapshots) == 0 {
+		return profile, fmt.Errorf("the profile has no snapshots")
+	}
+	return profile, nil
+}
+
+// peak is the snapshot with the most heap in use. massif marks it, and it is
+// the one with allocation sites unless the program's heap was always empty.
+func (p massifProfile) peak() massifSnapshot {
+	best := p.snapshots[0]
+	for _, snapshot := range p.snapshots {
+		if snapshot.peak && snapshot.tree != nil {
+			return snapshot
+		}
+		if snapshot.total() > best.total() {
+			best = snapshot
+		}
+	}
+	return best
+}
+
+// heapSite is a place the program allocated from, with the calls leading
+// to it
+type heapSite struct {
+	bytes   int64
+	callers []string
+}
+
+var massifAddressRegex = regexp.MustCompile(`^0x[0-9A-Fa-f]+: `)
+
+// topSites gives the biggest allocation sites in a snapshot. For each
+// function that called an allocation function, the largest path of calls to
+// it is followed a few frames so that it can be told where it came from.
+func (s massifSnapshot) topSites(count int) []heapSite {
+	if s.tree == nil {
+		return nil
+	}
+	sites := []heapSite{}
+	for _, node := range s.tree.children {
+		site := heapSite{bytes: node.bytes}
+		for frame := node; frame != nil && len(site.callers) < 4; {
+			site.callers = append(site.callers, massifAddressRegex.ReplaceAllString(frame.desc, ""))
+			var largest *massifNode
+			for _, child := range frame.children {
+				if largest == nil || child.bytes > largest.bytes {
+					largest = child
+				}
+			}
+			frame = largest
+		}
+		sites = append(sites, site)
+	}
+	sort.SliceStable(sites, func(i, j int) bool { return sites[i].bytes > sites[j].bytes })
+	if len(sites) > count {
+		sites = sites[:count]
+	}
+	return sites
+}
+
+var massifTimeUnits = map[string]string{
+	"i":  "instructions",
+	"ms": "ms",
+	"B":  "bytes allocated",
+}
+
+// heapColumns spreads the snapshots over a number of columns, giving the
+// most heap used during each. Columns without a snapshot keep the last value.
+func (p massifProfile) heapColumns(width int) []int64 {
+	end := p.snapshots[len(p.snapshots)-1].time
+	columns := make([]int64, width)
+	filled := make([]bool, width)
+	for _, snapshot := range p.snapshots {
+		column := 0
+		if end > 0 {
+			column = int(snapshot.time * int64(width-1) / end)
+		}
+		if !filled[column] || snapshot.total() > columns[column] {
+			columns[column] = snapshot.total()
+		}
+		filled[column] = true
+	}
+	for column := 1; column < width; column++ {
+		if !filled[column] {
+			columns[column] = columns[column-1]
+		}
+	}
+	return columns
+}
+
+// printHeapChart draws heap use over time in the terminal
+func printHeapChart(out io.Writer, profile massifProfile) {
+	const width, height = 60, 12
+	peak := profile.peak().total()
+	columns := profile.heapColumns(width)
+	label := func(row int) string {
+		switch row {
+		case height:
+			return units.BytesSize(float64(peak))
+		case height / 2:
+			return units.BytesSize(float64(peak) / 2)
+		}
+		return ""
+	}
+	for row := height; row > 0; row-- {
+		line := []byte(strings.Repeat(" ", width))
+		for column, value := range columns {
+			//a column is filled from the bottom up to the nearest row
+			if peak > 0 && value*2*height >= peak*int64(2*row-1) {
+				line[column] = '#'
+			}
+		}
+		fmt.Fprintf(out, "%10s |%s\n", label(row), line)
+	}
+	fmt.Fprintf(out, "%10s +%s\n", "0 B", strings.Repeat("-", width))
+	end := strconv.FormatInt(profile.snapshots[len(profile.snapshots)-1].time, 10)
+	unit := massifTimeUnits[profile.timeUnit]
+	fmt.Fprintf(out, "%10s  0%s%s %s\n", "", strings.Repeat(" ", width-1-len(end)), end, unit)
+}
+
+func printHeapSites(out io.Writer, snapshot massifSnapshot) {
+	sites := snapshot.topSites(10)
+	if len(sites) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "Top allocation sites at the peak:")
+	for _, site := range sites {
+		percent := 0.0
+		if snapshot.heap > 0 {
+			percent = float64(site.bytes) * 100 / float64(snapshot.heap)
+		}
+		fmt.Fprintf(out, "%10s %5.1f%%  %s\n", units.BytesSize(float64(site.bytes)), percent, site.callers[0])
+		for _, caller := range site.callers[1:] {
+			fmt.Fprintf(out, "%18s  from %s\n", "", caller)
+		}
+	}
+}
+
+// heapSVG draws heap use over time as an svg
+func heapSVG(profile massifProfile) string {
+	const width, height, margin = 800.0, 300.0, 70.0
+	peak := float64(profile.peak().total())
+	end := float64(profile.snapshots[len(profile.snapshots)-1].time)
+	x := func(time int64) float64 {
+		if end == 0 {
+			return margin
+		}
+		return margin + float64(time)/end*(width-2*margin)
+	}
+	y := func(bytes int64) float64 {
+		if peak == 0 {
+			return height - margin/2
+		}
+		return height - margin/2 - float64(bytes)/peak*(height-margin)
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="12">`+"\n", width, height)
+	points := fmt.Sprintf("%.1f,%.1f", x(0), y(0))
+	last := int64(0)
+	for _, snapshot := range profile.snapshots {
+		//heap use stays the same until the next snapshot
+		points += fmt.Sprintf(" %.1f,%.1f %.1f,%.1f", x(snapshot.time), y(last), x(snapshot.time), y(snapshot.total()))
+		last = snapshot.total()
+	}
+	points += fmt.Sprintf(" %.1f,%.1f", x(profile.snapshots[len(profile.snapshots)-1].time), y(0))
+	fmt.Fprintf(&svg, `<polygon points="%s" fill="#9ecae1" stroke="#3182bd"/>`+"\n", points)
+	fmt.Fprintf(&svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="black"/>`+"\n", margin, y(0), width-margin, y(0))
+	fmt.Fprintf(&svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="black"/>`+"\n", margin, y(0), margin, margin/2)
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="end">%s</text>`+"\n", margin-5, y(int64(peak))+4, units.BytesSize(peak))
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="end">0 B</text>`+"\n", margin-5, y(0)+4)
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="end">%.0f %s</text>`+"\n", width-margin, height-5, end, massifTimeUnits[profile.timeUnit])
+	fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f">heap use of %s</text>`+"\n", margin, margin/2-10, html.EscapeString(profile.cmd))
+	svg.WriteString("</svg>\n")
+	return svg.String()
+}
+
+// heapHTML is a page with the chart and the allocation sites at the peak
+func heapHTML(profile massifProfile) string {
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>cbug heap: " + html.EscapeString(profile.cmd) + "</title></head>\n<body style=\"font-family: sans-serif\">\n")
+	page.WriteString(heapSVG(profile))
+	peak := profile.peak()
+	page.WriteString("<h3>Top allocation sites at the peak (" + units.BytesSize(float64(peak.total())) + ")</h3>\n<table>\n")
+	for _, site := range peak.topSites(10) {
+		page.WriteString("<tr><td style=\"vertical-align: top; padding-right: 1em\">" + units.BytesSize(float64(site.bytes)) + "</td><td><code>" + html.EscapeString(site.callers[0]) + "</code>")
+		for _, caller := range site.callers[1:] {
+			page.WriteString("<br>&nbsp;&nbsp;from <code>" + html.EscapeString(caller) + "</code>")
+		}
+		page.WriteString("</td></tr>\n")
+	}
+	page.WriteString("</table>\n</body>\n</html>\n")
+	return page.String()
+}
+
+// reportHeap copies massif's profile out of the container into .cbug/heap
+// in the project, then shows it
+func reportHeap(conf configStruct, opts heapOptions) {
+	saveDir, err := artifactDir(conf, "heap")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to save the heap profile: "+err.Error())
+		return
+	}
+	saved := filepath.Join(saveDir, "massif.out."+time.Now().Format("2006-01-02T15-04-05"))
+	if err := moveOut(conf, opts.massifFile, saved); err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: massif didn't write a heap profile")
+		return
+	}
+
+	file, err := os.Open(saved)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the heap profile: "+err.Error())
+		return
+	}
+	profile, err := parseMassif(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the heap profile: "+err.Error())
+		return
+	}
+
+	peak := profile.peak()
+	fmt.Fprintln(os.Stderr, "cbug heap: peak of "+units.BytesSize(float64(peak.total()))+" ("+units.BytesSize(float64(peak.extra))+" of it allocator overhead)")
+	printHeapChart(os.Stderr, profile)
+	fmt.Fprintln(os.Stderr)
+	printHeapSites(os.Stderr, peak)
+	fmt.Fprintln(os.Stderr, "The full profile is saved in "+saved+", and can be viewed with ms_print or massif-visualizer")
+
+	exports := []struct {
+		file     string
+		contents func(massifProfile) string
+	}{{opts.svg, heapSVG}, {opts.html, heapHTML}}
+	for _, export := range exports {
+		file := export.file
+		if file == "" {
+			continue
+		}
+		if err := os.WriteFile(file, []byte(export.contents(profile)), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "cbug: unable to write "+file+": "+err.Error())
+			continue
+		}
+		fmt.Fprintln(os.Stderr, "Wrote "+file)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMassifOutput = `desc: --massif-out-file=/tmp/cbug/massif.out.x
+cmd: ./a.out big
+time_unit: i
+#-----------
+snapshot=0
+#-----------
+time=0
+mem_heap_B=0
+mem_heap_extra_B=0
+mem_stacks_B=0
+heap_tree=empty
+#-----------
+snapshot=1
+#-----------
+time=150000
+mem_heap_B=4000
+mem_heap_extra_B=24
+mem_stacks_B=0
+heap_tree=peak
+n2: 4000 (heap allocation functions) malloc/new/new[], --alloc-fns, etc.
+ n2: 3000 0x10916E: make (a.c:5)
+  n0: 2000 0x109190: main (a.c:10)
+  n0: 1000 0x1091B0: main (a.c:12)
+ n0: 1000 0x1091A0: main (a.c:11)
+#-----------
+snapshot=2
+#-----------
+time=200000
+mem_heap_B=1000
+mem_heap_extra_B=8
+mem_stacks_B=0
+heap_tree=detailed
+n1: 1000 (heap allocation functions) malloc/new/new[], --alloc-fns, etc.
+ n0: 1000 0x1091A0: main (a.c:11)
+`
+
+func TestParseMassif(t *testing.T) {
+	profile, err := parseMassif(strings.NewReader(testMassifOutput))
+	if err != nil {
+		t.Fatalf("parseMassif() = %v", err)
+	}
+	if profile.cmd != "./a.out big" || profile.timeUnit != "i" {
+		t.Errorf("cmd, time unit = %q, %q, want \"./a.out big\", \"i\"", profile.cmd, profile.timeUnit)
+	}
+	wantSnapshots := []struct {
+		time, heap, extra int64
+		peak, tree        bool
+	}{
+		{0, 0, 0, false, false},
+		{150000, 4000, 24, true, true},
+		{200000, 1000, 8, false, true},
+	}
+	if len(profile.snapshots) != len(wantSnapshots) {
+		t.Fatalf("got %d snapshots, want %d", len(profile.snapshots), len(wantSnapshots))
+	}
+	for i, want := range wantSnapshots {
+		got := profile.snapshots[i]
+		if got.time != want.time || got.heap != want.heap || got.extra != want.extra || got.peak != want.peak || (got.tree != nil) != want.tree {
+			t.Errorf("snapshot %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	tree := profile.snapshots[1].tree
+	if tree.bytes != 4000 || len(tree.children) != 2 {
+		t.Fatalf("peak tree = %d bytes with %d children, want 4000 with 2", tree.bytes, len(tree.children))
+	}
+	site := tree.children[0]
+	if site.desc != "0x10916E: make (a.c:5)" || len(site.children) != 2 || site.children[1].bytes != 1000 {
+		t.Errorf("first site = %+v, want make with two callers", site)
+	}
+
+	sites := profile.peak().topSites(5)
+	wantSites := []heapSite{
+		{3000, []string{"make (a.c:5)", "main (a.c:10)"}},
+		{1000, []string{"main (a.c:11)"}},
+	}
+	if !reflect.DeepEqual(sites, wantSites) {
+		t.Errorf("topSites() = %+v, want %+v", sites, wantSites)
+	}
+}
+
+func TestParseMassifEmpty(t *testing.T) {
+	if _, err := parseMassif(strings.NewReader("desc: x\ncmd: ./a.out\n")); err == nil {
+		t.Fatal("parseMassif() = nil, want an error for a profile with no snapshots")
+	}
+}
+
+func TestMassifPeak(t *testing.T) {
+	tree := &massifNode{bytes: 100}
+	tests := []struct {
+		name      string
+		snapshots []massifSnapshot
+		want      int
+	}{
+		{
+			"marked peak",
+			[]massifSnapshot{{heap: 10}, {heap: 100, peak: true, tree: tree}, {heap: 50}},
+			1,
+		},
+		{
+			"marked peak without a tree",
+			[]massifSnapshot{{heap: 10}, {heap: 100, peak: true}, {heap: 50}},
+			1,
+		},
+		{
+			"largest with overhead",
+			[]massifSnapshot{{heap: 100, extra: 0}, {heap: 90, extra: 20}, {heap: 50}},
+			1,
+		},
+		{
+			"always empty",
+			[]massifSnapshot{{time: 1}, {time: 2}},
+			0,
+		},
+	}
+	for _, test := range tests {
+		profile := massifProfile{snapshots: test.snapshots}
+		if got := profile.peak(); !reflect.DeepEqual(got, test.snapshots[test.want]) {
+			t.Errorf("%s: peak() = %+v, want snapshot %d", test.name, got, test.want)
+		}
+	}
+}
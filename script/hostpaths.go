@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/term"
+)
+
+// pathWriter rewrites paths in the container's /debugger to the matching path
+// on this computer as output streams through it, so that compiler errors and
+// stack traces can be clicked on in editors and terminals.
+type pathWriter struct {
+	out  io.Writer
+	from []byte
+	to   []byte
+	//a match can be split between two writes, so the end of a write that
+	//could be the start of one is held until the next write
+	pending []byte
+	//the byte before pending, to tell if a match is the start of a path
+	previous byte
+	//whether pending starts in the middle of a color escape sequence
+	inEscape bool
+	//writes pending if nothing else arrives in time
+	timer *time.Timer
+	mutex sync.Mutex
+}
+
+// flushDelay is how long pending is held before being written anyway. Without
+// it, a / typed into a program reading from the terminal wouldn't be echoed
+// until the next key.
+const flushDelay = 20 * time.Millisecond
+
+func newPathWriter(out io.Writer, hostRoot string) *pathWriter {
+	return &pathWriter{
+		out:      out,
+		from:     []byte(containerWorkdir + "/"),
+		to:       []byte(hostRoot + "/"),
+		previous: ' ',
+	}
+}
+
+// isPathByte reports whether b can be part of a path, so that something like
+// /home/debugger/ isn't mistaken for /debugger/
+func isPathByte(b byte) bool {
+	return b == '/' || b == '.' || b == '-' || b == '_' ||
+		(b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+func (w *pathWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	data := append(w.pending, p...)
+	w.pending = nil
+
+	//previous[i] and inEscape[i] are the state before data[i], so that the
+	//next write can pick up from wherever this one stops
+	previous := make([]byte, len(data)+1)
+	inEscape := make([]bool, len(data)+1)
+	previous[0], inEscape[0] = w.previous, w.inEscape
+
+	var out bytes.Buffer
+	matchEnd := 0
+	for i := 0; i < len(data); {
+		if !inEscape[i] && !isPathByte(previous[i]) && bytes.HasPrefix(data[i:], w.from) {
+			out.Write(w.to)
+			i += len(w.from)
+			previous[i], inEscape[i] = '/', false
+			matchEnd = i
+			continue
+		}
+		out.WriteByte(data[i])
+		previous[i+1], inEscape[i+1] = data[i], inEscape[i]
+		if data[i] == 0x1b {
+			inEscape[i+1] = true
+		} else if inEscape[i] && data[i] >= '@' && data[i] <= '~' && data[i] != '[' {
+			//colors are written as ESC [ ... m, and the m shouldn't count as
+			//part of a path right before a match
+			previous[i+1], inEscape[i+1] = ' ', false
+		}
+		i++
+	}
+
+	//hold back the longest end of the data that could start a match, as
+	//long as it isn't part of a match that was already replaced
+	keep := 0
+	for k := len(w.from) - 1; k > 0; k-- {
+		if len(data)-k >= matchEnd && bytes.HasSuffix(data, w.from[:k]) {
+			keep = k
+			break
+		}
+	}
+	split := len(data) - keep
+	w.pending = append([]byte{}, data[split:]...)
+	w.previous, w.inEscape = previous[split], inEscape[split]
+	out.Truncate(out.Len() - keep)
+	if keep > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(flushDelay, func() { w.Flush() })
+		} else {
+			w.timer.Reset(flushDelay)
+		}
+	}
+
+	if _, err := w.out.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes anything held back waiting for the rest of a possible match
+func (w *pathWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(w.pending)
+	w.previous = w.pending[len(w.pending)-1]
+	w.pending = nil
+	return err
+}
+
+// hostPath gives the path on this computer matching a path in /debugger.
+// Other paths are left as they are.
+func hostPath(hostRoot string, containerPath string) string {
+	if hostRoot == "" {
+		return containerPath
+	}
+	if containerPath == containerWorkdir || strings.HasPrefix(containerPath, containerWorkdir+"/") {
+		return filepath.Join(hostRoot, filepath.FromSlash(strings.TrimPrefix(containerPath, containerWorkdir)))
+	}
+	return containerPath
+}
+
+// translatePaths decides whether command output should have container paths
+// rewritten. By default this only happens when the output is a terminal,
+// where the paths are meant to be clicked, and not when it is piped into a
+// file or another program. Interactive commands are never rewritten, since
+// shells and gdb need each keystroke echoed as soon as it is typed.
+func translatePaths(conf configStruct, flags flagStruct, interactive bool) bool {
+	if interactive {
+		return false
+	}
+	setting := conf.HostPaths
+	if flags.hostPaths != "" {
+		setting = flags.hostPaths
+	}
+	switch setting {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return term.IsTerminal(os.Stdout.Fd())
+}
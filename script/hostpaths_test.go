@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPathWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"compiler error", "/debugger/main.c:3:5: error: expected ';'\n", "/home/me/project/main.c:3:5: error: expected ';'\n"},
+		{"in the middle of a line", "at f (/debugger/src/f.c:10)\n", "at f (/home/me/project/src/f.c:10)\n"},
+		{"more than one", "/debugger/a.c and /debugger/b.c", "/home/me/project/a.c and /home/me/project/b.c"},
+		{"part of a longer path", "/home/debugger/a.c x/debugger/b.c", "/home/debugger/a.c x/debugger/b.c"},
+		{"the folder itself", "cd /debugger\n", "cd /debugger\n"},
+		{"colored", "\x1b[1m/debugger/a.c:1:1:\x1b[0m", "\x1b[1m/home/me/project/a.c:1:1:\x1b[0m"},
+		{"start of a match at the end", "ends with /debug", "ends with /debug"},
+		{"no paths", "hello\n", "hello\n"},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//every way of splitting the output into two writes, then one
+			//byte at a time
+			for split := 0; split <= len(test.in); split++ {
+				var out bytes.Buffer
+				writer := newPathWriter(&out, "/home/me/project")
+				writer.Write([]byte(test.in[:split]))
+				writer.Write([]byte(test.in[split:]))
+				writer.Flush()
+				if out.String() != test.want {
+					t.Errorf("split at %d: got %q, want %q", split, out.String(), test.want)
+				}
+			}
+			var out bytes.Buffer
+			writer := newPathWriter(&out, "/home/me/project")
+			for i := 0; i < len(test.in); i++ {
+				writer.Write([]byte{test.in[i]})
+			}
+			writer.Flush()
+			if out.String() != test.want {
+				t.Errorf("byte at a time: got %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+// chanWriter sends each write on a channel
+type chanWriter chan string
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	c <- string(p)
+	return len(p), nil
+}
+
+func TestPathWriterFlushesWhenIdle(t *testing.T) {
+	out := make(chanWriter, 10)
+	writer := newPathWriter(out, "/home/me/project")
+	writer.Write([]byte("$ ls /"))
+	if got := <-out; got != "$ ls " {
+		t.Fatalf("first write = %q, want %q", got, "$ ls ")
+	}
+	select {
+	case got := <-out:
+		if got != "/" {
+			t.Errorf("held back write = %q, want %q", got, "/")
+		}
+	case <-time.After(time.Second):
+		t.Error("the held back / was never written")
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	tests := []struct {
+		hostRoot      string
+		containerPath string
+		want          string
+	}{
+		{"/home/me/project", "/debugger/src/a.c", "/home/me/project/src/a.c"},
+		{"/home/me/project", "/debugger", "/home/me/project"},
+		{"/home/me/project", "/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"/home/me/project", "/debuggerx/a.c", "/debuggerx/a.c"},
+		{"", "/debugger/src/a.c", "/debugger/src/a.c"},
+	}
+	for _, test := range tests {
+		if got := hostPath(test.hostRoot, test.containerPath); got != test.want {
+			t.Errorf("hostPath(%q, %q) = %q, want %q", test.hostRoot, test.containerPath, got, test.want)
+		}
+	}
+}
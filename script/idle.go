@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// idleBehaviour leaves the container running after a command, and pauses or
+// stops it once cbug hasn't been used for a while. This avoids starting the
+// container for every command without leaving it running all day.
+type idleBehaviour struct {
+	after time.Duration
+	pause bool
+}
+
+// parseIdle reads the <duration>[:pause|:shutdown] part of an idle behaviour,
+// like 30m or 1h:pause. The container is shut down unless pause is given.
+func parseIdle(value string) (idleBehaviour, error) {
+	durationString, action, _ := strings.Cut(value, ":")
+	after, err := time.ParseDuration(durationString)
+	if err != nil || after <= 0 {
+		return idleBehaviour{}, errors.New("invalid idle time \"" + durationString + "\", use a time like 30m or 1h")
+	}
+	idle := idleBehaviour{after: after}
+	switch action {
+	case "pause":
+		idle.pause = true
+	case "", "shutdown":
+	default:
+		return idleBehaviour{}, errors.New("unrecognized idle behaviour \"" + action + "\", use pause or shutdown")
+	}
+	return idle, nil
+}
+
+// idleWatchCommand is the hidden command cbug starts itself with to watch a
+// container in the background
+const idleWatchCommand = "__idle-watch"
+
+// lastUsedFile is touched by every command, so its modification time is the
+// last time the container was used
+const lastUsedFile = "last-used"
+
+// idleLockFile is held by the watcher so that a container only has one
+const idleLockFile = "idle.lock"
+
+func markUsed(containerName string) {
+	state := stateDir(containerName)
+	if os.MkdirAll(state, 0755) != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(state, lastUsedFile), nil, 0644)
+}
+
+func lastUsed(containerName string) time.Time {
+	info, err := os.Stat(filepath.Join(stateDir(containerName), lastUsedFile))
+	if err != nil {
+		//the state was cleared because the container was removed
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// tryLock locks a file without waiting, returning nil if it is already locked
+func tryLock(containerName string, name string) *os.File {
+	file, err := os.OpenFile(filepath.Join(stateDir(containerName), name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil
+	}
+	if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+// startIdleWatcher records that the container was just used and makes sure a
+// watcher is running for it. The watcher is a separate cbug process, so it
+// keeps going after this command and the terminal it ran in are gone.
+func startIdleWatcher(execLoc string, containerName string, idle idleBehaviour) {
+	markUsed(containerName)
+	lock := tryLock(containerName, idleLockFile)
+	if lock == nil {
+		//a watcher is already running, and will see the new last-used time
+		return
+	}
+	lock.Close()
+
+	action := "shutdown"
+	if idle.pause {
+		action = "pause"
+	}
+	watcher := exec.Command(execLoc, idleWatchCommand, containerName, idle.after.String(), action)
+	watcher.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := watcher.Start(); err == nil {
+		watcher.Process.Release()
+	}
+}
+
+// watchIdle is the background watcher. It waits until the container has gone
+// unused for long enough and no command is using it, then pauses or stops it
+// and exits.
+func watchIdle(args []string) {
+	if len(args) != 3 {
+		os.Exit(1)
+	}
+	containerName := args[0]
+	idle, err := parseIdle(args[1] + ":" + args[2])
+	if err != nil {
+		os.Exit(1)
+	}
+	lock := tryLock(containerName, idleLockFile)
+	if lock == nil {
+		return
+	}
+	defer lock.Close()
+	dockerCli, err := client.NewEnvClient()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	for {
+		if wait := time.Until(lastUsed(containerName).Add(idle.after)); wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		containerLease, err := acquireLease(containerName)
+		if err != nil {
+			return
+		}
+		if !containerLease.last() {
+			//a command is still running, and will update last-used when it ends
+			containerLease.release()
+			time.Sleep(time.Minute)
+			continue
+		}
+		//a command may have finished while waiting for the lease
+		if time.Since(lastUsed(containerName)) < idle.after {
+			containerLease.release()
+			continue
+		}
+
+		//the container is looked up by name in case it was replaced
+		containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerName)
+		if err == nil && containerInfo.State.Running && !containerInfo.State.Paused {
+			if idle.pause {
+				dockerCli.ContainerPause(context.Background(), containerInfo.ID)
+			} else {
+				delay := time.Duration(1) * time.Second
+				dockerCli.ContainerStop(context.Background(), containerInfo.ID, &delay)
+			}
+		}
+		containerLease.release()
+		return
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseIdle(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    idleBehaviour
+		wantErr bool
+	}{
+		{"30m", idleBehaviour{after: 30 * time.Minute}, false},
+		{"1h", idleBehaviour{after: time.Hour}, false},
+		{"1h30m:shutdown", idleBehaviour{after: 90 * time.Minute}, false},
+		{"45s:pause", idleBehaviour{after: 45 * time.Second, pause: true}, false},
+		{"", idleBehaviour{}, true},
+		{"30", idleBehaviour{}, true},
+		{"0s", idleBehaviour{}, true},
+		{"-5m", idleBehaviour{}, true},
+		{"30m:stop", idleBehaviour{}, true},
+		{"pause", idleBehaviour{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseIdle(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseIdle(%q) = %+v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseIdle(%q) = %+v, %v, want %+v", test.value, got, err, test.want)
+		}
+	}
+}
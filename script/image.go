@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// defaultImage is used when no imageName is configured
+const defaultImage = "eleanormally/cpp-memory-debugger"
+
+// cbugLabel is set on every container cbug creates
+const cbugLabel = "cbug"
+
+// imageRepo splits the configured image into its repository and tag. The tag
+// is "latest" unless one is configured.
+func imageRepo(conf configStruct) (string, string) {
+	image := conf.DockerContainer
+	if image == "" {
+		image = defaultImage
+	}
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// isCbugImage reports whether a container's image is one cbug would have made it from
+func isCbugImage(conf configStruct, image string) bool {
+	repo, _ := imageRepo(conf)
+	return strings.Contains(image, defaultImage) || strings.Contains(image, repo)
+}
+
+// isCbugContainer reports whether cbug created a container. Containers made
+// before cbug labelled them are recognised by their image, which only works
+// while the image's tag still points at it.
+func isCbugContainer(conf configStruct, dContainer types.Container) bool {
+	return dContainer.Labels[cbugLabel] == "1" || isCbugImage(conf, dContainer.Image)
+}
+
+// selectedArch is the architecture forced by a flag, or the computer's own otherwise
+func selectedArch(info infoStruct, flags flagStruct) string {
+	if flags.arch != "" {
+		return flags.arch
+	}
+	return info.arch()
+}
+
+// resolveImage finds the image reference to use for arch. Images published
+// as manifest lists have every architecture under one tag, so the registry
+// (or the local copy, when offline) is checked for arch first. Older images
+// were published as a separate tag per architecture, which is used as a
+// fallback when the configured tag doesn't have arch.
+func resolveImage(dockerCli *client.Client, conf configStruct, arch string) (string, error) {
+	repo, tag := imageRepo(conf)
+	ref := repo + ":" + tag
+
+	distribution, err := dockerCli.DistributionInspect(context.Background(), ref, "")
+	if err == nil {
+		for _, imagePlatform := range distribution.Platforms {
+			if (imagePlatform.OS == "linux" || imagePlatform.OS == "") && normalizeArch(imagePlatform.Architecture) == arch {
+				return ref, nil
+			}
+		}
+	} else if imageHasArch(dockerCli, ref, arch) {
+		return ref, nil
+	}
+
+	if legacy, ok := legacyTag(arch); ok && tag == "latest" {
+		return repo + ":" + string(legacy), nil
+	}
+	return "", errors.New(ref + " has no image for " + arch)
+}
+
+// imageHasArch reports whether ref has been downloaded for arch
+func imageHasArch(dockerCli *client.Client, ref string, arch string) bool {
+	imageInfo, _, err := dockerCli.ImageInspectWithRaw(context.Background(), ref)
+	return err == nil && normalizeArch(imageInfo.Architecture) == arch
+}
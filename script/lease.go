@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// Several cbug commands can use the same container at once, like a program
+// running in one terminal while another compiles. They coordinate through
+// lock files in the container's state directory. The kernel drops a process'
+// locks when it exits, so a crashed cbug can't leave a container locked.
+const (
+	//every command using a container holds a shared lock on the lease file
+	//for as long as it runs, so the last one out can tell it is the last
+	leaseFile = "lease.lock"
+	//commands hold a shared lock on the files lock while they use
+	//files in /debugger, and sync and clean hold it exclusively
+	filesLockFile = "files.lock"
+)
+
+// lockFile opens and locks one of a container's lock files. If it is already
+// locked in a way that conflicts, waiting is printed before blocking until
+// the lock is free.
+func lockFile(containerName string, name string, exclusive bool, waiting string) (*os.File, error) {
+	state := stateDir(containerName)
+	if err := os.MkdirAll(state, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(state, name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		if waiting != "" {
+			fmt.Println(waiting)
+		}
+		err = syscall.Flock(int(file.Fd()), how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// lease is one cbug command's claim on a container
+type lease struct {
+	file *os.File
+}
+
+// acquireLease registers a command as using a container. This waits if
+// another command is in the middle of stopping or pausing it, or is running
+// with its own resource limits.
+func acquireLease(containerName string) (*lease, error) {
+	file, err := lockFile(containerName, leaseFile, false, "Waiting for another cbug command to finish with \""+containerName+"\"...")
+	if err != nil {
+		return nil, err
+	}
+	return &lease{file: file}, nil
+}
+
+// last reports whether no other command holds a lease on the container. When
+// it does, the lease becomes exclusive until it is released, so nothing can
+// start using the container while it is being stopped or paused.
+func (l *lease) last() bool {
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
+
+// share goes back to sharing the container after last made the lease
+// exclusive
+func (l *lease) share() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_SH)
+}
+
+func (l *lease) release() {
+	l.file.Close()
+}
+
+// finishContainer applies the exit behaviour when a command is done with a
+// container. It is only paused or stopped by the last command using it.
+func finishContainer(dockerCli *client.Client, execLoc string, containerLease *lease, containerName string, containerID string, flags flagStruct) {
+	if flags.pause {
+		if containerLease.last() {
+			dockerCli.ContainerPause(context.Background(), containerID)
+		}
+	} else if flags.stop {
+		if !containerLease.last() {
+			fmt.Println("Leaving cbug container running for other cbug commands using it")
+			return
+		}
+		fmt.Print("Stopping cbug container... ")
+		delay := time.Duration(1) * time.Second
+		dockerCli.ContainerStop(context.Background(), containerID, &delay)
+		fmt.Println("Done")
+	} else if flags.idle.after > 0 {
+		startIdleWatcher(execLoc, containerName, flags.idle)
+	}
+}
+
+// lockFiles keeps the files in /debugger from being replaced while a command
+// uses them, or, when exclusive, waits for every command using them to finish
+// so they can be replaced. The returned function releases the lock.
+func lockFiles(containerName string, exclusive bool) func() {
+	waiting := "Waiting for cbug sync or clean to finish..."
+	if exclusive {
+		waiting = "Waiting for other cbug commands using \"" + containerName + "\" to finish..."
+	}
+	file, err := lockFile(containerName, filesLockFile, exclusive, waiting)
+	ifErr(err, "Error locking container files: ", true)
+	return func() { file.Close() }
+}
+
+// isLockFile is used to keep lock files when a container's state is cleared,
+// since other commands may hold them
+func isLockFile(name string) bool {
+	return strings.HasSuffix(name, ".lock")
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+type matrixCell struct {
+	arch      string
+	compiler  string
+	opt       string
+	container string
+	baseEnv   []string
+
+	buildCode   int
+	buildOutput string
+	runCode     int
+	runStdout   string
+	runStderr   string
+	err         error
+}
+
+func (c matrixCell) name() string {
+	return c.arch + "-" + c.compiler + "-" + c.opt
+}
+
+// workdir is where the cell's copy of the files lives. Cells with the same
+// architecture share a container, so each gets its own directory.
+func (c matrixCell) workdir() string {
+	return "/matrix/" + c.compiler + "-" + c.opt
+}
+
+// env sets the usual make variables, so a plain "make" or "$CXX $CXXFLAGS"
+// build picks up the cell's compiler and optimization level
+func (c matrixCell) env() []string {
+	env := append([]string{}, c.baseEnv...)
+	cc, cxx := c.compiler, c.compiler
+	switch c.compiler {
+	case "gcc":
+		cxx = "g++"
+	case "clang":
+		cxx = "clang++"
+	}
+	opt := "-" + strings.TrimPrefix(c.opt, "-")
+	return append(env, "CC="+cc, "CXX="+cxx, "CFLAGS="+opt, "CXXFLAGS="+opt, "OPT="+opt)
+}
+
+// runMatrix runs the same build and run commands for every combination of
+// architecture, compiler and optimization level, then prints how they
+// compare. It returns the exit code for cbug, rather than exiting itself, so
+// that every container is still paused or stopped when something fails.
+func runMatrix(execLoc string, dockerCli *client.Client, conf configStruct, releaseInfo infoStruct, flags flagStruct, env []string, args []string) int {
+	arches := []string{releaseInfo.arch()}
+	compilers := []string{"gcc"}
+	opts := []string{"O0"}
+	command := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			command = strings.Join(args[i+1:], " ")
+			break
+		}
+		if i+1 >= len(args) {
+			fmt.Println("Missing value for matrix option \"" + args[i] + "\"")
+			os.Exit(1)
+		}
+		values := strings.Split(args[i+1], ",")
+		switch args[i] {
+		case "--arch":
+			arches = []string{}
+			for _, arch := range values {
+				arches = append(arches, parseArch(arch))
+			}
+		case "--compiler":
+			compilers = values
+		case "--opt":
+			opts = values
+		default:
+			fmt.Println("Unknown matrix option \"" + args[i] + "\"")
+			os.Exit(1)
+		}
+		i++
+	}
+	build, run, _ := strings.Cut(command, ";")
+	build, run = strings.TrimSpace(build), strings.TrimSpace(run)
+	if build == "" {
+		fmt.Println("Error, no build command given. Usage: cbug matrix [--arch a,b] [--compiler a,b] [--opt a,b] -- <build> ; <run>")
+		os.Exit(1)
+	}
+
+	workdir, err := os.Getwd()
+	if err != nil {
+		fmt.Println("Error accessing current directory")
+		return 1
+	}
+
+	containers := map[string]string{}
+	for _, arch := range arches {
+		containerConf := conf
+		containerConf.ContainerName = conf.ContainerName + "-" + arch
+		containerLease, err := acquireLease(containerConf.ContainerName)
+		if err != nil {
+			fmt.Println("Error registering with cbug container: " + err.Error())
+			return 1
+		}
+		defer containerLease.release()
+		containerID, err := findContainer(dockerCli, containerConf)
+		if err != nil {
+			fmt.Println("Error: " + err.Error())
+			return 1
+		}
+		if containerID == "" {
+			containerID = createContainer(dockerCli, containerConf, releaseInfo, arch, false)
+		}
+		if err = startContainer(dockerCli, containerID); err != nil {
+			fmt.Println("Error starting Docker container: " + err.Error())
+			return 1
+		}
+		containers[arch] = containerConf.ContainerName
+		defer finishContainer(dockerCli, execLoc, containerLease, containerConf.ContainerName, containerID, flags)
+	}
+
+	cells := []*matrixCell{}
+	for _, arch := range arches {
+		for _, compiler := range compilers {
+			for _, opt := range opts {
+				cells = append(cells, &matrixCell{arch: arch, compiler: compiler, opt: opt, container: containers[arch], baseEnv: env})
+			}
+		}
+	}
+
+	fmt.Printf("Running %d configurations...\n", len(cells))
+	var wg sync.WaitGroup
+	for _, cell := range cells {
+		wg.Add(1)
+		go func(cell *matrixCell) {
+			defer wg.Done()
+			cell.err = runMatrixCell(cell, workdir, build, run)
+			fmt.Println("  finished " + cell.name())
+		}(cell)
+	}
+	wg.Wait()
+
+	if !printMatrix(cells, run != "") {
+		return 1
+	}
+	return 0
+}
+
+// findContainer looks up the cbug container named conf.ContainerName. An
+// empty ID means it doesn't exist yet.
+func findContainer(dockerCli *client.Client, conf configStruct) (string, error) {
+	containers, err := dockerCli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return "", err
+	}
+	for _, dContainer := range containers {
+		for _, name := range dContainer.Names {
+			if name != "/"+conf.ContainerName {
+				continue
+			}
+			if !isCbugContainer(conf, dContainer) {
+				return "", errors.New("found a docker container with the name \"" + conf.ContainerName + "\" in use not by cbug")
+			}
+			return dContainer.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// startContainer makes sure a container is running, whether it was stopped or paused
+func startContainer(dockerCli *client.Client, containerID string) error {
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return err
+	}
+	if containerInfo.State.Paused {
+		return dockerCli.ContainerUnpause(context.Background(), containerID)
+	}
+	if !containerInfo.State.Running {
+		return dockerCli.ContainerStart(context.Background(), containerID, types.ContainerStartOptions{})
+	}
+	return nil
+}
+
+func runMatrixCell(cell *matrixCell, workdir string, build string, run string) error {
+	err := exec.Command("docker", "exec", cell.container, "bash", "-c", "rm -rf "+cell.workdir()+" && mkdir -p "+cell.workdir()).Run()
+	if err != nil {
+		return errors.New("unable to clean " + cell.workdir() + ": " + err.Error())
+	}
+	err = copyProject(workdir, cell.container, cell.workdir())
+	if err != nil {
+		return errors.New("unable to copy files: " + err.Error())
+	}
+
+	var buildOutput bytes.Buffer
+	cell.buildCode, err = cell.exec(build, &buildOutput, &buildOutput)
+	cell.buildOutput = buildOutput.String()
+	if err != nil || cell.buildCode != 0 || run == "" {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cell.runCode, err = cell.exec(run, &stdout, &stderr)
+	cell.runStdout = stdout.String()
+	cell.runStderr = stderr.String()
+	return err
+}
+
+// exec runs a shell command in the cell's directory and returns its exit code
+func (c matrixCell) exec(command string, stdout *bytes.Buffer, stderr *bytes.Buffer) (int, error) {
+	comArgs := append([]string{"exec", "-w", c.workdir()}, envArgs(c.env())...)
+	comArgs = append(comArgs, c.container, "bash", "-c", command)
+	cmd := exec.Command("docker", comArgs...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+var (
+	valgrindErrors = regexp.MustCompile(`ERROR SUMMARY: (\d+) errors`)
+	valgrindLeaks  = regexp.MustCompile(`definitely lost: ([\d,]+) bytes`)
+	sanitizerError = regexp.MustCompile(`ERROR: (\w+Sanitizer): ([\w-]+)`)
+)
+
+// findings pulls a short summary of memory check results out of the output
+func (c matrixCell) findings() string {
+	output := c.runStdout + c.runStderr
+	found := []string{}
+	if match := valgrindErrors.FindStringSubmatch(output); match != nil && match[1] != "0" {
+		found = append(found, match[1]+" valgrind errors")
+	}
+	if match := valgrindLeaks.FindStringSubmatch(output); match != nil && match[1] != "0" {
+		found = append(found, match[1]+" bytes leaked")
+	}
+	for _, match := range sanitizerError.FindAllStringSubmatch(output, -1) {
+		found = append(found, match[1]+" "+match[2])
+	}
+	if len(found) == 0 {
+		return "-"
+	}
+	return strings.Join(found, ", ")
+}
+
+// printMatrix shows a grid of the results and the output differences
+// between cells, and returns whether every cell succeeded
+func printMatrix(cells []*matrixCell, ran bool) bool {
+	var reference *matrixCell
+	for _, cell := range cells {
+		if cell.err == nil && cell.buildCode == 0 {
+			reference = cell
+			break
+		}
+	}
+
+	ok := true
+	fmt.Println()
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ARCH\tCOMPILER\tOPT\tBUILD\tRUN\tFINDINGS\tOUTPUT")
+	for _, cell := range cells {
+		buildResult, runResult, findings, output := "ok", "-", "-", "-"
+		switch {
+		case cell.err != nil:
+			buildResult = "error"
+			ok = false
+		case cell.buildCode != 0:
+			buildResult = "exit " + strconv.Itoa(cell.buildCode)
+			ok = false
+		case ran:
+			runResult = "exit " + strconv.Itoa(cell.runCode)
+			findings = cell.findings()
+			if cell.runCode != 0 || findings != "-" {
+				ok = false
+			}
+			if cell == reference {
+				output = "reference"
+			} else if cell.runStdout == reference.runStdout {
+				output = "same"
+			} else {
+				output = "differs"
+				ok = false
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", cell.arch, cell.compiler, cell.opt, buildResult, runResult, findings, output)
+	}
+	table.Flush()
+
+	for _, cell := range cells {
+		switch {
+		case cell.err != nil:
+			fmt.Println("\n" + cell.name() + ": " + cell.err.Error())
+		case cell.buildCode != 0:
+			fmt.Println("\n" + cell.name() + " build output:")
+			fmt.Print(cell.buildOutput)
+		case ran && cell != reference && cell.runStdout != reference.runStdout:
+			fmt.Println("\n" + cell.name() + " output compared to " + reference.name() + ":")
+			fmt.Print(lineDiff(reference.runStdout, cell.runStdout))
+		}
+	}
+	return ok
+}
+
+// maxDiffLines stops lineDiff from building huge tables for long outputs
+const maxDiffLines = 2000
+
+// lineDiff gives a minimal line by line diff of two outputs, with lines only
+// in a prefixed by - and lines only in b prefixed by +
+func lineDiff(a string, b string) string {
+	aLines := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bLines := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	if len(aLines) > maxDiffLines || len(bLines) > maxDiffLines {
+		return fmt.Sprintf("  outputs are too long to compare (%d and %d lines)\n", len(aLines), len(bLines))
+	}
+
+	//longest common subsequence table, filled from the end so it can be walked forwards
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] > lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			diff.WriteString("  + " + bLines[j] + "\n")
+			j++
+		default:
+			diff.WriteString("  - " + aLines[i] + "\n")
+			i++
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"identical", "one\ntwo\n", "one\ntwo\n", ""},
+		{"insertion", "one\nthree\n", "one\ntwo\nthree\n", "  + two\n"},
+		{"deletion", "one\ntwo\nthree\n", "one\nthree\n", "  - two\n"},
+		{"changed line", "one\ntwo\n", "one\n2\n", "  + 2\n  - two\n"},
+		{"missing trailing newline", "one\ntwo", "one\ntwo\n", ""},
+		{
+			"too long",
+			strings.Repeat("line\n", maxDiffLines+1),
+			"line\n",
+			"  outputs are too long to compare (2001 and 1 lines)\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := lineDiff(test.a, test.b); got != test.want {
+				t.Errorf("lineDiff() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindings(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		stderr string
+		want   string
+	}{
+		{"nothing", "hello\n", "", "-"},
+		{"clean valgrind", "", "==12== definitely lost: 0 bytes in 0 blocks\n==12== ERROR SUMMARY: 0 errors from 0 contexts\n", "-"},
+		{
+			"valgrind errors and leaks",
+			"",
+			"==12== definitely lost: 1,024 bytes in 1 blocks\n==12== ERROR SUMMARY: 3 errors from 2 contexts\n",
+			"3 valgrind errors, 1,024 bytes leaked",
+		},
+		{
+			"sanitizers",
+			"==7==ERROR: AddressSanitizer: heap-use-after-free on address 0x602000000010\n",
+			"==7==ERROR: LeakSanitizer: detected memory leaks\n",
+			"AddressSanitizer heap-use-after-free, LeakSanitizer detected",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cell := matrixCell{runStdout: test.stdout, runStderr: test.stderr}
+			if got := cell.findings(); got != test.want {
+				t.Errorf("findings() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrintMatrix(t *testing.T) {
+	built := func(stdout string) *matrixCell {
+		return &matrixCell{arch: "amd64", compiler: "gcc", opt: "O0", runStdout: stdout}
+	}
+	tests := []struct {
+		name  string
+		cells []*matrixCell
+		ran   bool
+		want  bool
+	}{
+		{"same output", []*matrixCell{built("1\n"), built("1\n")}, true, true},
+		{"different output", []*matrixCell{built("1\n"), built("2\n")}, true, false},
+		{
+			"reference skips failed builds",
+			[]*matrixCell{{buildCode: 2}, built("1\n"), built("1\n")},
+			true,
+			false,
+		},
+		{"non zero exit", []*matrixCell{built("1\n"), {runCode: 1, runStdout: "1\n"}}, true, false},
+		{"findings", []*matrixCell{built("1\n"), {runStdout: "1\n", runStderr: "ERROR SUMMARY: 1 errors from 1 contexts"}}, true, false},
+		{"only built", []*matrixCell{built(""), built("")}, false, true},
+	}
+
+	//printMatrix writes the table to stdout, which isn't needed here
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	for _, test := range tests {
+		if got := printMatrix(test.cells, test.ran); got != test.want {
+			t.Errorf("%s: printMatrix() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
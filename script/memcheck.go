@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// vgdbDebugger runs valgrind so that it stops at the first memory error, and
+// then connects gdb to it through vgdb. valgrind's messages are written to a
+// log that is shown as it grows, and watched for the message valgrind gives
+// once it is waiting for a debugger. The program and gdb share the terminal,
+// but only one of them runs at a time.
+//
+// valgrind has to run in the background, where sh ignores ctrl-c for it, and
+// cbug's pid file points at sh rather than valgrind. So sh passes ctrl-c and
+// the signals cbug forwards on to valgrind itself, except that ctrl-c is
+// left to gdb while gdb is running.
+const vgdbDebugger = `mkdir -p ` + pidDir + `
+log="` + pidDir + `/vgdb-$$.log"
+prefix="` + pidDir + `/vgdb-$$"
+gdbinit="$1"
+program="$(command -v "$2" || echo "$2")"
+shift
+: > "$log"
+exec 3<&0
+valgrind --tool=memcheck --vgdb=yes --vgdb-error=1 --vgdb-prefix="$prefix" --log-file="$log" "$@" <&3 3<&- &
+pid=$!
+debugging=
+trap '[ -n "$debugging" ] || kill $pid 2>/dev/null' INT QUIT
+trap 'kill $pid 2>/dev/null' TERM HUP
+tail -n +1 -s 0.1 -f --pid=$pid "$log" >&2 &
+while kill -0 $pid 2>/dev/null; do
+	if grep -q "TO DEBUG THIS PROCESS USING GDB" "$log"; then
+		sleep 0.2
+		echo "cbug: stopped at the first memory error, starting gdb" >&2
+		set -- gdb -q
+		[ -n "$gdbinit" ] && set -- "$@" -x "$gdbinit"
+		debugging=1
+		"$@" -ex "target remote | vgdb --pid=$pid --vgdb-prefix=$prefix" "$program" <&3
+		debugging=
+		break
+	fi
+	sleep 0.1
+done
+wait $pid
+code=$?
+wait
+rm -f "$log"
+exit $code`
+
+// memcheckCommand builds the command for cbug memcheck. With
+// --debug-on-error the program stops at the first error valgrind reports and
+// gdb is opened where it happened.
+func memcheckCommand(conf configStruct, args []string) []string {
+	debug := debugsOnError(args)
+	if debug {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Println("Usage: cbug memcheck [--debug-on-error] <program> [args]")
+		os.Exit(1)
+	}
+	if !debug {
+		return append([]string{"valgrind", "--tool=memcheck"}, args...)
+	}
+	gdbInit := ""
+	if conf.GdbInit != "" {
+		gdbInit = copyGdbInit(conf)
+	}
+	return append([]string{"sh", "-c", vgdbDebugger, "cbug", gdbInit}, args...)
+}
+
+// debugsOnError reports whether cbug memcheck was asked to open gdb, which
+// needs the container to allow debugging
+func debugsOnError(args []string) bool {
+	return len(args) > 0 && args[0] == "--debug-on-error"
+}
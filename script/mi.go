@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+)
+
+// miRecord is one line of output from gdb's machine interface. Results are
+// c-strings, tuples (map[string]interface{}) or lists ([]interface{}). A list
+// of name=value results keeps just the values.
+type miRecord struct {
+	token int
+	//kind is ^ for results, * + = for async events, ~ @ & for streams, and
+	//0 for output from the program that isn't part of the protocol
+	kind    byte
+	class   string
+	results map[string]interface{}
+	text    string
+}
+
+type miParser struct {
+	line string
+	pos  int
+}
+
+func (p *miParser) peek() byte {
+	if p.pos >= len(p.line) {
+		return 0
+	}
+	return p.line[p.pos]
+}
+
+func (p *miParser) cString() (string, error) {
+	if p.peek() != '"' {
+		return "", errors.New("expected string")
+	}
+	p.pos++
+	var out strings.Builder
+	for p.pos < len(p.line) {
+		c := p.line[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return out.String(), nil
+		case '\\':
+			if p.pos >= len(p.line) {
+				return "", errors.New("unfinished escape")
+			}
+			c = p.line[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case 'r':
+				out.WriteByte('\r')
+			case 'e':
+				out.WriteByte(0x1b)
+			default:
+				//gdb writes other bytes as octal
+				if c >= '0' && c <= '7' && p.pos+1 < len(p.line) {
+					if value, err := strconv.ParseUint(p.line[p.pos-1:p.pos+2], 8, 8); err == nil {
+						out.WriteByte(byte(value))
+						p.pos += 2
+						continue
+					}
+				}
+				out.WriteByte(c)
+			}
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return "", errors.New("unfinished string")
+}
+
+func (p *miParser) name() string {
+	start := p.pos
+	for p.pos < len(p.line) && p.line[p.pos] != '=' && p.line[p.pos] != ',' && p.line[p.pos] != '}' && p.line[p.pos] != ']' {
+		p.pos++
+	}
+	return p.line[start:p.pos]
+}
+
+func (p *miParser) value() (interface{}, error) {
+	switch p.peek() {
+	case '"':
+		return p.cString()
+	case '{':
+		p.pos++
+		tuple := map[string]interface{}{}
+		if p.peek() == '}' {
+			p.pos++
+			return tuple, nil
+		}
+		for {
+			name, value, err := p.result()
+			if err != nil {
+				return nil, err
+			}
+			tuple[name] = value
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case '}':
+				p.pos++
+				return tuple, nil
+			default:
+				return nil, errors.New("expected , or }")
+			}
+		}
+	case '[':
+		p.pos++
+		list := []interface{}{}
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+		for {
+			var value interface{}
+			var err error
+			if c := p.peek(); c == '"' || c == '{' || c == '[' {
+				value, err = p.value()
+			} else {
+				_, value, err = p.result()
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case ']':
+				p.pos++
+				return list, nil
+			default:
+				return nil, errors.New("expected , or ]")
+			}
+		}
+	}
+	return nil, errors.New("expected value")
+}
+
+func (p *miParser) result() (string, interface{}, error) {
+	name := p.name()
+	if p.peek() != '=' {
+		return "", nil, errors.New("expected =")
+	}
+	p.pos++
+	value, err := p.value()
+	return name, value, err
+}
+
+// parseMI reads one line of gdb/mi output. Lines that aren't gdb/mi come from
+// the program being debugged.
+func parseMI(line string) miRecord {
+	other := miRecord{token: -1, text: line}
+	p := miParser{line: line}
+	for p.pos < len(line) && line[p.pos] >= '0' && line[p.pos] <= '9' {
+		p.pos++
+	}
+	record := miRecord{token: -1, kind: p.peek(), results: map[string]interface{}{}}
+	if p.pos > 0 {
+		record.token, _ = strconv.Atoi(line[:p.pos])
+	}
+	p.pos++
+	switch record.kind {
+	case '~', '@', '&':
+		if p.pos != 1 {
+			return other
+		}
+		text, err := p.cString()
+		if err != nil {
+			return other
+		}
+		record.text = text
+		return record
+	case '^', '*', '+', '=':
+		start := p.pos
+		for p.pos < len(line) && line[p.pos] != ',' {
+			p.pos++
+		}
+		record.class = line[start:p.pos]
+		for p.peek() == ',' {
+			p.pos++
+			name, value, err := p.result()
+			if err != nil {
+				return other
+			}
+			record.results[name] = value
+		}
+		if p.pos != len(line) {
+			return other
+		}
+		return record
+	}
+	return other
+}
+
+// miString gets a string from a tuple, or "" if it isn't there
+func miString(tuple interface{}, key string) string {
+	if values, ok := tuple.(map[string]interface{}); ok {
+		if value, ok := values[key].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// miList gets a list from a tuple
+func miList(tuple interface{}, key string) []interface{} {
+	if values, ok := tuple.(map[string]interface{}); ok {
+		if list, ok := values[key].([]interface{}); ok {
+			return list
+		}
+	}
+	return nil
+}
+
+// miQuote makes a c-string for a gdb/mi command. gdb only understands c
+// escapes, so other characters, including unicode, are passed through as
+// they are and control characters are written in octal.
+func miQuote(value string) string {
+	quoted := strings.Builder{}
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' || c == '"':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			quoted.Write([]byte{'\\', '0' + c>>6, '0' + c>>3&7, '0' + c&7})
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// gdbMI drives gdb through its machine interface. Results go to the command
+// that asked for them, and everything else is sent to events.
+type gdbMI struct {
+	session   *execSession
+	in        io.WriteCloser
+	mu        sync.Mutex
+	nextToken int
+	pending   map[int]chan miRecord
+	events    chan miRecord
+	//exited is closed once gdb does
+	exited chan struct{}
+}
+
+func startGdbMI(dockerCli *client.Client, containerID string, opts execOptions) (*gdbMI, error) {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	opts.stdin, opts.stdout, opts.stderr = inReader, outWriter, outWriter
+	session, err := startExec(dockerCli, containerID, opts)
+	if err != nil {
+		return nil, err
+	}
+	gdb := &gdbMI{
+		session: session,
+		in:      inWriter,
+		pending: map[int]chan miRecord{},
+		events:  make(chan miRecord, 64),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		<-session.done
+		outWriter.Close()
+	}()
+	go func() {
+		scanner := bufio.NewScanner(outReader)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if strings.TrimSpace(line) == "(gdb)" {
+				continue
+			}
+			record := parseMI(line)
+			if record.kind == '^' {
+				gdb.mu.Lock()
+				result, waiting := gdb.pending[record.token]
+				delete(gdb.pending, record.token)
+				gdb.mu.Unlock()
+				if waiting {
+					result <- record
+					continue
+				}
+			}
+			gdb.events <- record
+		}
+		close(gdb.exited)
+		close(gdb.events)
+	}()
+	return gdb, nil
+}
+
+// command runs a gdb/mi command and waits for its result
+func (g *gdbMI) command(command string) (miRecord, error) {
+	result := make(chan miRecord, 1)
+	g.mu.Lock()
+	g.nextToken++
+	token := g.nextToken
+	g.pending[token] = result
+	g.mu.Unlock()
+	if _, err := io.WriteString(g.in, strconv.Itoa(token)+command+"\n"); err != nil {
+		return miRecord{}, err
+	}
+	select {
+	case record := <-result:
+		if record.class == "error" {
+			return record, errors.New(miString(record.results, "msg"))
+		}
+		return record, nil
+	case <-g.exited:
+		return miRecord{}, errors.New("gdb exited")
+	}
+}
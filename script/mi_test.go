@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMI(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want miRecord
+	}{
+		{
+			"result with a token",
+			`12^done`,
+			miRecord{token: 12, kind: '^', class: "done", results: map[string]interface{}{}},
+		},
+		{
+			"error",
+			`3^error,msg="No symbol \"x\" in current context."`,
+			miRecord{token: 3, kind: '^', class: "error", results: map[string]interface{}{"msg": `No symbol "x" in current context.`}},
+		},
+		{
+			"stopped at a breakpoint",
+			`*stopped,reason="breakpoint-hit",bkptno="1",frame={addr="0x1139",func="main",args=[],file="a.c",line="4"},thread-id="1"`,
+			miRecord{token: -1, kind: '*', class: "stopped", results: map[string]interface{}{
+				"reason": "breakpoint-hit",
+				"bkptno": "1",
+				"frame": map[string]interface{}{
+					"addr": "0x1139",
+					"func": "main",
+					"args": []interface{}{},
+					"file": "a.c",
+					"line": "4",
+				},
+				"thread-id": "1",
+			}},
+		},
+		{
+			"list of results keeps the values",
+			`^done,stack=[frame={level="0",func="f"},frame={level="1",func="main"}]`,
+			miRecord{token: -1, kind: '^', class: "done", results: map[string]interface{}{
+				"stack": []interface{}{
+					map[string]interface{}{"level": "0", "func": "f"},
+					map[string]interface{}{"level": "1", "func": "main"},
+				},
+			}},
+		},
+		{
+			"list of values",
+			`=thread-group-added,ids=["i1","i2"],empty={}`,
+			miRecord{token: -1, kind: '=', class: "thread-group-added", results: map[string]interface{}{
+				"ids":   []interface{}{"i1", "i2"},
+				"empty": map[string]interface{}{},
+			}},
+		},
+		{
+			"console stream with escapes",
+			`~"line\n\ttabbed \"quoted\" \\ \033[0m\n"`,
+			miRecord{token: -1, kind: '~', text: "line\n\ttabbed \"quoted\" \\ \x1b[0m\n", results: map[string]interface{}{}},
+		},
+		{
+			"program output",
+			`hello from the program`,
+			miRecord{token: -1, text: "hello from the program"},
+		},
+		{
+			"program output that looks like a record",
+			`^ not a record, really`,
+			miRecord{token: -1, text: "^ not a record, really"},
+		},
+		{
+			"unfinished string",
+			`~"no end`,
+			miRecord{token: -1, text: `~"no end`},
+		},
+		{
+			"stream with a token",
+			`5~"text"`,
+			miRecord{token: -1, text: `5~"text"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseMI(test.line); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseMI(%q) =\n%#v\nwant\n%#v", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMIQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"main.c:12", `"main.c:12"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\path`, `"C:\\path"`},
+		{"tab\tnewline\n", `"tab\011newline\012"`},
+		{"\x1b\x7f", `"\033\177"`},
+		{"héllo ☃", `"héllo ☃"`},
+		{"", `""`},
+	}
+	for _, test := range tests {
+		got := miQuote(test.value)
+		if got != test.want {
+			t.Errorf("miQuote(%q) = %s, want %s", test.value, got, test.want)
+		}
+		//gdb reads it back the same way cbug reads gdb's strings
+		parser := miParser{line: got}
+		if back, err := parser.cString(); err != nil || back != test.value {
+			t.Errorf("reading miQuote(%q) back = %q, %v", test.value, back, err)
+		}
+	}
+}
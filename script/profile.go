@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// profileOptions are the options given to cbug profile
+type profileOptions struct {
+	//outFile is where valgrind writes its profile in the container
+	outFile string
+	cache   bool
+	output  string
+}
+
+// profileCommand builds the command for cbug profile, which runs a program
+// under callgrind, or cachegrind with --cache, to see where it spends time
+func profileCommand(args []string) ([]string, profileOptions) {
+	opts := profileOptions{}
+	for len(args) > 0 {
+		if args[0] == "--cache" {
+			opts.cache = true
+			args = args[1:]
+		} else if (args[0] == "-o" || args[0] == "--output") && len(args) > 1 {
+			opts.output = args[1]
+			args = args[2:]
+		} else {
+			break
+		}
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: cbug profile [--cache] [-o file] <program> [args]")
+		os.Exit(1)
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	opts.outFile = pidDir + "/callgrind.out." + id
+	tool := []string{"--tool=callgrind", "--callgrind-out-file=" + opts.outFile}
+	if opts.cache {
+		opts.outFile = pidDir + "/cachegrind.out." + id
+		tool = []string{"--tool=cachegrind", "--cache-sim=yes", "--cachegrind-out-file=" + opts.outFile}
+	}
+	return append(append([]string{"valgrind"}, tool...), args...), opts
+}
+
+// grindLocation is a line of code costs are counted against
+type grindLocation struct {
+	function string
+	file     string
+	line     int64
+}
+
+// grindCall is a call to a function from a location, with the cost of
+// everything done during it
+type grindCall struct {
+	caller grindLocation
+	cost   []int64
+}
+
+// grindProfile is what callgrind or cachegrind measured. Callgrind also
+// records the calls between functions, but not whole call stacks.
+type grindProfile struct {
+	cmd     string
+	events  []string
+	self    map[grindLocation][]int64
+	callers map[string][]grindCall
+}
+
+func addCosts(total []int64, costs []int64) []int64 {
+	for len(total) < len(costs) {
+		total = append(total, 0)
+	}
+	for i, cost := range costs {
+		total[i] += cost
+	}
+	return total
+}
+
+// parseGrind reads the output of callgrind or cachegrind, which share a
+// format. Names can be compressed, where "(id) name" gives a name an id the
+// first time it is used and "(id)" refers to it after. Positions can be
+// relative to the last one, like "+3", or "*" for the same.
+func parseGrind(r io.Reader) (grindProfile, error) {
+	profile := grindProfile{self: map[grindLocation][]int64{}, callers: map[string][]grindCall{}}
+	//files, functions and objects each have their own ids
+	names := map[string]map[string]string{"fl": {}, "fn": {}, "ob": {}}
+	kinds := map[string]string{"fl": "fl", "fi": "fl", "fe": "fl", "cfi": "fl", "cfl": "fl", "fn": "fn", "cfn": "fn", "ob": "ob", "cob": "ob"}
+	name := func(kind string, value string) string {
+		if !strings.HasPrefix(value, "(") {
+			return value
+		}
+		id, rest, _ := strings.Cut(value[1:], ")")
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			names[kind][id] = rest
+			return rest
+		}
+		return names[kind][id]
+	}
+
+	positions := []string{"line"}
+	lastPositions := make([]int64, 1)
+	var function, fnFile, file, callee string
+	inCall := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if c := line[0]; (c >= '0' && c <= '9') || c == '+' || c == '-' || c == '*' {
+			fields := strings.Fields(line)
+			if len(fields) < len(positions) {
+				continue
+			}
+			location := grindLocation{function: function, file: file}
+			for i, position := range positions {
+				value := fields[i]
+				switch {
+				case value == "*":
+				case value[0] == '+' || value[0] == '-':
+					offset, _ := strconv.ParseInt(value, 0, 64)
+					lastPositions[i] += offset
+				default:
+					lastPositions[i], _ = strconv.ParseInt(value, 0, 64)
+				}
+				if position == "line" {
+					location.line = lastPositions[i]
+				}
+			}
+			costs := make([]int64, len(profile.events))
+			for i, value := range fields[len(positions):] {
+				if i < len(costs) {
+					costs[i], _ = strconv.ParseInt(value, 10, 64)
+				}
+			}
+			if inCall {
+				//the cost after a calls= line is the cost of the call
+				profile.callers[callee] = append(profile.callers[callee], grindCall{caller: location, cost: costs})
+				inCall = false
+			} else {
+				profile.self[location] = addCosts(profile.self[location], costs)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			key, value, found = strings.Cut(line, ":")
+			value = strings.TrimSpace(value)
+			if !found {
+				continue
+			}
+			switch key {
+			case "cmd":
+				profile.cmd = value
+			case "events":
+				profile.events = strings.Fields(value)
+			case "positions":
+				positions = strings.Fields(value)
+				lastPositions = make([]int64, len(positions))
+			}
+			continue
+		}
+		switch key {
+		case "fl":
+			fnFile = name(kinds[key], value)
+			file = fnFile
+		case "fi", "fe":
+			file = name(kinds[key], value)
+		case "fn":
+			function = name(kinds[key], value)
+			//inlined code from other files only lasts until the next function
+			file = fnFile
+		case "cfn":
+			callee = name(kinds[key], value)
+		case "cfi", "cfl", "ob", "cob":
+			name(kinds[key], value)
+		case "calls":
+			inCall = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return profile, err
+	}
+	if len(profile.events) == 0 {
+		return profile, fmt.Errorf("the profile has no events")
+	}
+	return profile, nil
+}
+
+// grindSample is the cost counted in a call stack, which is leaf first
+type grindSample struct {
+	stack []grindLocation
+	costs []int64
+}
+
+// samples estimates the call stacks costs were counted in. Callgrind only
+// records how much of a function's cost came from each place it was called
+// from, so the cost of each line is split between callers in the same
+// proportion, up the call graph. Splits too small to matter and recursive
+// calls aren't followed further.
+func (p grindProfile) samples() []grindSample {
+	var total int64
+	for _, costs := range p.self {
+		if len(costs) > 0 {
+			total += costs[0]
+		}
+	}
+	smallest := float64(total) / 100000
+	const maxDepth = 64
+
+	stacks := map[string][]grindLocation{}
+	weights := map[string][]float64{}
+	var walk func(stack []grindLocation, costs []int64, weight float64)
+	walk = func(stack []grindLocation, costs []int64, weight float64) {
+		function := stack[len(stack)-1].function
+		calls := []grindCall{}
+		var callTotal int64
+		if len(stack) < maxDepth && (len(costs) == 0 || weight*float64(costs[0]) >= smallest) {
+			for _, call := range p.callers[function] {
+				recursive := false
+				for _, location := range stack {
+					if location.function == call.caller.function {
+						recursive = true
+					}
+				}
+				if !recursive {
+					calls = append(calls, call)
+					if len(call.cost) > 0 {
+						callTotal += call.cost[0]
+					}
+				}
+			}
+		}
+		if len(calls) == 0 {
+			key := fmt.Sprint(stack)
+			stacks[key] = append([]grindLocation{}, stack...)
+			for len(weights[key]) < len(costs) {
+				weights[key] = append(weights[key], 0)
+			}
+			for i, cost := range costs {
+				weights[key][i] += weight * float64(cost)
+			}
+			return
+		}
+		for _, call := range calls {
+			share := 1 / float64(len(calls))
+			if callTotal > 0 && len(call.cost) > 0 {
+				share = float64(call.cost[0]) / float64(callTotal)
+			}
+			if share > 0 {
+				walk(append(stack, call.caller), costs, weight*share)
+			}
+		}
+	}
+	for location, costs := range p.self {
+		empty := true
+		for _, cost := range costs {
+			empty = empty && cost == 0
+		}
+		if !empty {
+			walk([]grindLocation{location}, costs, 1)
+		}
+	}
+
+	//sorted so that the same profile always converts the same way
+	keys := make([]string, 0, len(stacks))
+	for key := range stacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := []grindSample{}
+	for _, key := range keys {
+		sample := grindSample{stack: stacks[key]}
+		for _, weight := range weights[key] {
+			sample.costs = append(sample.costs, int64(weight+0.5))
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// toPprof converts a profile to pprof's format, with file paths in
+// /debugger changed to the matching ones on this computer
+func (p grindProfile) toPprof(hostRoot string) *profile.Profile {
+	converted := &profile.Profile{TimeNanos: time.Now().UnixNano()}
+	for _, event := range p.events {
+		converted.SampleType = append(converted.SampleType, &profile.ValueType{Type: event, Unit: "count"})
+	}
+	if len(p.events) > 0 {
+		converted.DefaultSampleType = p.events[0]
+	}
+
+	//one mapping that says everything is already symbolized, so pprof
+	//doesn't look for the program
+	program := p.cmd
+	if fields := strings.Fields(program); len(fields) > 0 {
+		program = fields[0]
+	}
+	mapping := &profile.Mapping{
+		ID:              1,
+		File:            program,
+		HasFunctions:    true,
+		HasFilenames:    true,
+		HasLineNumbers:  true,
+		HasInlineFrames: true,
+	}
+	converted.Mapping = []*profile.Mapping{mapping}
+
+	type functionKey struct{ name, file string }
+	functions := map[functionKey]*profile.Function{}
+	locations := map[grindLocation]*profile.Location{}
+	locationAt := func(at grindLocation) *profile.Location {
+		if location, exists := locations[at]; exists {
+			return location
+		}
+		file := hostPath(hostRoot, at.file)
+		key := functionKey{at.function, file}
+		function, exists := functions[key]
+		if !exists {
+			function = &profile.Function{
+				ID:         uint64(len(functions) + 1),
+				Name:       at.function,
+				SystemName: at.function,
+				Filename:   file,
+			}
+			functions[key] = function
+			converted.Function = append(converted.Function, function)
+		}
+		location := &profile.Location{
+			ID:      uint64(len(locations) + 1),
+			Mapping: mapping,
+			Line:    []profile.Line{{Function: function, Line: at.line}},
+		}
+		locations[at] = location
+		converted.Location = append(converted.Location, location)
+		return location
+	}
+
+	for _, grindSample := range p.samples() {
+		sample := &profile.Sample{Value: grindSample.costs}
+		for _, at := range grindSample.stack {
+			sample.Location = append(sample.Location, locationAt(at))
+		}
+		converted.Sample = append(converted.Sample, sample)
+	}
+	return converted
+}
+
+// reportProfile copies valgrind's profile out of the container into
+// .cbug/profile in the project, and converts it for go tool pprof
+func reportProfile(conf configStruct, opts profileOptions) {
+	saveDir, err := artifactDir(conf, "profile")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to save the profile: "+err.Error())
+		return
+	}
+	tool := "callgrind"
+	if opts.cache {
+		tool = "cachegrind"
+	}
+	saved := filepath.Join(saveDir, tool+".out."+time.Now().Format("2006-01-02T15-04-05"))
+	if err := moveOut(conf, opts.outFile, saved); err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: "+tool+" didn't write a profile")
+		return
+	}
+
+	file, err := os.Open(saved)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the profile: "+err.Error())
+		return
+	}
+	profile, err := parseGrind(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the profile: "+err.Error())
+		return
+	}
+
+	output := opts.output
+	if output == "" {
+		output = saved + ".pb.gz"
+	}
+	outFile, err := os.Create(output)
+	if err == nil {
+		err = profile.toPprof(projectRoot(conf)).Write(outFile)
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to write "+output+": "+err.Error())
+		return
+	}
+	fmt.Fprintln(os.Stderr, "cbug profile: saved the "+tool+" profile to "+saved+" and a pprof profile to "+output)
+	fmt.Fprintln(os.Stderr, "View it with:")
+	fmt.Fprintln(os.Stderr, "\tgo tool pprof -http=: "+output)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+const testCallgrindOutput = `# callgrind format
+version: 1
+creator: callgrind-3.18.1
+pid: 42
+cmd:  ./a.out input.txt
+part: 1
+
+positions: line
+events: Ir
+
+ob=(1) /debugger/a.out
+fl=(1) /debugger/a.c
+fn=(1) main
+5 10
++1 3
+cfi=(1)
+cfn=(2) work
+calls=2 10
++1 305
+fn=(2)
+10 100
++2 100
+fi=(2) /debugger/util.h
+20 5
+fe=(1)
+* 100
+fn=(1)
+-15 1
+
+totals: 419
+`
+
+const testCachegrindOutput = `desc: I1 cache: 32768 B, 64 B, 8-way associative
+cmd: ./a.out
+events: Ir I1mr ILmr
+fl=/debugger/a.c
+fn=main
+5 10 1 1
+6 4 0 0
+fn=helper
+9 2 1 0
+`
+
+func TestParseGrind(t *testing.T) {
+	main5 := grindLocation{"main", "/debugger/a.c", 5}
+	main6 := grindLocation{"main", "/debugger/a.c", 6}
+	main7 := grindLocation{"main", "/debugger/a.c", 7}
+	tests := []struct {
+		name        string
+		in          string
+		wantCmd     string
+		wantEvents  []string
+		wantSelf    map[grindLocation][]int64
+		wantCallers map[string][]grindCall
+	}{
+		{
+			"callgrind",
+			testCallgrindOutput,
+			"./a.out input.txt",
+			[]string{"Ir"},
+			map[grindLocation][]int64{
+				main5:                            {11},
+				main6:                            {3},
+				{"work", "/debugger/a.c", 10}:    {100},
+				{"work", "/debugger/a.c", 12}:    {100},
+				{"work", "/debugger/util.h", 20}: {5},
+				{"work", "/debugger/a.c", 20}:    {100},
+			},
+			map[string][]grindCall{
+				"work": {{caller: main7, cost: []int64{305}}},
+			},
+		},
+		{
+			"cachegrind",
+			testCachegrindOutput,
+			"./a.out",
+			[]string{"Ir", "I1mr", "ILmr"},
+			map[grindLocation][]int64{
+				main5:                          {10, 1, 1},
+				main6:                          {4, 0, 0},
+				{"helper", "/debugger/a.c", 9}: {2, 1, 0},
+			},
+			map[string][]grindCall{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseGrind(strings.NewReader(test.in))
+			if err != nil {
+				t.Fatalf("parseGrind() = %v", err)
+			}
+			if got.cmd != test.wantCmd {
+				t.Errorf("cmd = %q, want %q", got.cmd, test.wantCmd)
+			}
+			if !reflect.DeepEqual(got.events, test.wantEvents) {
+				t.Errorf("events = %q, want %q", got.events, test.wantEvents)
+			}
+			if !reflect.DeepEqual(got.self, test.wantSelf) {
+				t.Errorf("self costs = %v, want %v", got.self, test.wantSelf)
+			}
+			if !reflect.DeepEqual(got.callers, test.wantCallers) {
+				t.Errorf("callers = %v, want %v", got.callers, test.wantCallers)
+			}
+		})
+	}
+}
+
+func TestParseGrindNoEvents(t *testing.T) {
+	if _, err := parseGrind(strings.NewReader("cmd: ./a.out\nfn=main\n")); err == nil {
+		t.Fatal("parseGrind() = nil, want an error for a profile with no events")
+	}
+}
+
+// stackKey writes a pprof sample's stack, leaf first, like
+// "work a.c:10;main a.c:7"
+func stackKey(sample *profile.Sample) string {
+	frames := []string{}
+	for _, location := range sample.Location {
+		for _, line := range location.Line {
+			frames = append(frames, line.Function.Name+" "+line.Function.Filename+":"+strconv.FormatInt(line.Line, 10))
+		}
+	}
+	return strings.Join(frames, ";")
+}
+
+func TestToPprof(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		hostRoot  string
+		wantTypes []string
+		want      map[string][]int64
+	}{
+		{
+			"callgrind",
+			testCallgrindOutput,
+			"/home/me/project",
+			[]string{"Ir"},
+			map[string][]int64{
+				"main /home/me/project/a.c:5":                                 {11},
+				"main /home/me/project/a.c:6":                                 {3},
+				"work /home/me/project/a.c:10;main /home/me/project/a.c:7":    {100},
+				"work /home/me/project/a.c:12;main /home/me/project/a.c:7":    {100},
+				"work /home/me/project/util.h:20;main /home/me/project/a.c:7": {5},
+				"work /home/me/project/a.c:20;main /home/me/project/a.c:7":    {100},
+			},
+		},
+		{
+			"cachegrind without a project root",
+			testCachegrindOutput,
+			"",
+			[]string{"Ir", "I1mr", "ILmr"},
+			map[string][]int64{
+				"main /debugger/a.c:5":   {10, 1, 1},
+				"main /debugger/a.c:6":   {4, 0, 0},
+				"helper /debugger/a.c:9": {2, 1, 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grind, err := parseGrind(strings.NewReader(test.in))
+			if err != nil {
+				t.Fatalf("parseGrind() = %v", err)
+			}
+			var written bytes.Buffer
+			if err := grind.toPprof(test.hostRoot).Write(&written); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			parsed, err := profile.Parse(&written)
+			if err != nil {
+				t.Fatalf("pprof can't read the profile: %v", err)
+			}
+			if err := parsed.CheckValid(); err != nil {
+				t.Fatalf("pprof says the profile isn't valid: %v", err)
+			}
+
+			types := []string{}
+			for _, sampleType := range parsed.SampleType {
+				types = append(types, sampleType.Type)
+				if sampleType.Unit != "count" {
+					t.Errorf("unit of %s = %q, want count", sampleType.Type, sampleType.Unit)
+				}
+			}
+			if !reflect.DeepEqual(types, test.wantTypes) {
+				t.Errorf("sample types = %q, want %q", types, test.wantTypes)
+			}
+			if parsed.DefaultSampleType != test.wantTypes[0] {
+				t.Errorf("default sample type = %q, want %q", parsed.DefaultSampleType, test.wantTypes[0])
+			}
+			if len(parsed.Mapping) != 1 || !parsed.Mapping[0].HasFunctions || !parsed.Mapping[0].HasLineNumbers {
+				t.Errorf("mappings = %+v, want one that is already symbolized", parsed.Mapping)
+			}
+
+			got := map[string][]int64{}
+			for _, sample := range parsed.Sample {
+				got[stackKey(sample)] = sample.Value
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("samples =\n%v\nwant\n%v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// containerWorkdir is where synced files live in the container
+const containerWorkdir = "/debugger"
+
+// stateDir is where cbug keeps what it knows about a container on this
+// computer, like where its files were synced from. It is kept in the user's
+// state folder, since cbug may be installed somewhere it can't write to.
+func stateDir(containerName string) string {
+	return filepath.Join(userStateDir(), containerName)
+}
+
+// userStateDir follows $XDG_STATE_HOME on linux, and uses the application
+// support folder on macos
+func userStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "cbug")
+	}
+	if runtime.GOOS != "darwin" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "cbug")
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "cbug", "state")
+	}
+	return filepath.Join(os.TempDir(), "cbug-state")
+}
+
+// clearState forgets everything about a container, for when it is removed
+// or replaced by a new one with the same name
+func clearState(containerName string) {
+	state := stateDir(containerName)
+	entries, err := os.ReadDir(state)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !isLockFile(entry.Name()) {
+			os.RemoveAll(filepath.Join(state, entry.Name()))
+		}
+	}
+}
+
+// projectRoot is the host folder that /debugger mirrors. A root in the
+// config wins over the folder the container was last synced from.
+func projectRoot(conf configStruct) string {
+	if conf.ProjectRoot != "" {
+		return conf.ProjectRoot
+	}
+	root, err := os.ReadFile(filepath.Join(stateDir(conf.ContainerName), "project-root"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(root))
+}
+
+// syncFiles replaces the files in the container with the ones in the
+// current directory, and remembers the directory as the project root
+func syncFiles(conf configStruct) {
+	fmt.Print("Syncing files between current directory and cbug... ")
+	err := exec.Command("docker", "exec", conf.ContainerName, "bash", "/custom/removeAll.sh").Run()
+	ifErr(err, "Error cleaning container: ", true)
+	workdir, err := os.Getwd()
+	ifErr(err, "Error accessing current directory", false)
+	err = copyProject(workdir, conf.ContainerName, containerWorkdir)
+	ifErr(err, "Error copying files to docker container: ", true)
+
+	state := stateDir(conf.ContainerName)
+	if err = os.MkdirAll(state, 0755); err == nil {
+		err = os.WriteFile(filepath.Join(state, "project-root"), []byte(workdir), 0644)
+	}
+	ifErr(err, "Error saving project root: ", true)
+	fmt.Println("Done")
+}
+
+// copyProject copies the files in a folder into a folder in a container. It
+// works like docker cp, but leaves out .cbug, which holds what cbug brought
+// back from earlier runs, like core dumps, and shouldn't be copied back in.
+func copyProject(dir string, containerName string, dest string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeProjectArchive(writer, dir))
+	}()
+	command := exec.Command("docker", "cp", "-", containerName+":"+dest)
+	command.Stdin = reader
+	err := command.Run()
+	//stops the archive being written if docker cp gave up early
+	reader.Close()
+	return err
+}
+
+// writeProjectArchive writes the files in a folder as a tar archive, which
+// is what docker cp reads from stdin
+func writeProjectArchive(out io.Writer, dir string) error {
+	archive := tar.NewWriter(out)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+		if name == artifactFolder {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		//sockets and pipes can't be copied, and docker cp skips them too
+		if info.Mode()&(os.ModeSocket|os.ModeNamedPipe) != 0 {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = archive.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		contents, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+		_, err = io.Copy(archive, contents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// execWorkdir works out the directory in the container that matches the
+// current directory on this computer. override is the -w flag, which is
+// relative to /debugger unless it is absolute.
+func execWorkdir(conf configStruct, override string) (string, error) {
+	if override != "" {
+		if path.IsAbs(override) {
+			return override, nil
+		}
+		return path.Join(containerWorkdir, override), nil
+	}
+
+	root := projectRoot(conf)
+	if root == "" {
+		return containerWorkdir, nil
+	}
+	workdir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	//symlinks (like /tmp on macos) would otherwise make the two paths look unrelated
+	if resolved, err := filepath.EvalSymlinks(workdir); err == nil {
+		workdir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	relative, err := filepath.Rel(root, workdir)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", errors.New("the current directory is outside of the project synced to cbug (" + root + "). Run \"cbug sync\" here, or use -w to pick a directory in the container")
+	}
+	return path.Join(containerWorkdir, filepath.ToSlash(relative)), nil
+}
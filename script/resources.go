@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+)
+
+// resourceLimits are kept as the user wrote them (e.g. "256m") so that the
+// config file stays readable
+type resourceLimits struct {
+	Memory     string `json:"memory,omitempty"`
+	MemorySwap string `json:"memorySwap,omitempty"`
+	CPUs       string `json:"cpus,omitempty"`
+	Pids       string `json:"pids,omitempty"`
+}
+
+func (r resourceLimits) empty() bool {
+	return r == resourceLimits{}
+}
+
+// merge returns r with any limits set in override replacing its own
+func (r resourceLimits) merge(override resourceLimits) resourceLimits {
+	if override.Memory != "" {
+		r.Memory = override.Memory
+	}
+	if override.MemorySwap != "" {
+		r.MemorySwap = override.MemorySwap
+	}
+	if override.CPUs != "" {
+		r.CPUs = override.CPUs
+	}
+	if override.Pids != "" {
+		r.Pids = override.Pids
+	}
+	return r
+}
+
+// dockerResources converts the limits to what docker expects. Like docker
+// itself, a memory limit without a swap limit allows as much swap as memory.
+func (r resourceLimits) dockerResources() (container.Resources, error) {
+	resources := container.Resources{}
+	var err error
+	if r.Memory != "" {
+		if resources.Memory, err = units.RAMInBytes(r.Memory); err != nil {
+			return resources, errors.New("invalid memory limit \"" + r.Memory + "\"")
+		}
+		resources.MemorySwap = resources.Memory * 2
+	}
+	if r.MemorySwap != "" {
+		if r.MemorySwap == "-1" {
+			resources.MemorySwap = -1
+		} else if resources.MemorySwap, err = units.RAMInBytes(r.MemorySwap); err != nil {
+			return resources, errors.New("invalid swap limit \"" + r.MemorySwap + "\"")
+		}
+	}
+	if r.CPUs != "" {
+		cpus, err := strconv.ParseFloat(r.CPUs, 64)
+		if err != nil || cpus <= 0 {
+			return resources, errors.New("invalid cpu limit \"" + r.CPUs + "\"")
+		}
+		resources.NanoCPUs = int64(cpus * 1e9)
+	}
+	if r.Pids != "" {
+		pids, err := strconv.ParseInt(r.Pids, 10, 64)
+		if err != nil {
+			return resources, errors.New("invalid pids limit \"" + r.Pids + "\"")
+		}
+		resources.PidsLimit = &pids
+	}
+	return resources, nil
+}
+
+// updateResources applies limits to a running container, and returns a
+// function that puts back the limits it had before. Docker can't remove a
+// limit once one is set, so a limit that wasn't there before is restored to
+// what the docker machine has in total instead.
+func updateResources(dockerCli *client.Client, containerID string, limits resourceLimits) (func(), error) {
+	resources, err := limits.dockerResources()
+	if err != nil {
+		return nil, err
+	}
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+	previous := containerInfo.HostConfig.Resources
+	if _, err = dockerCli.ContainerUpdate(context.Background(), containerID, container.UpdateConfig{Resources: resources}); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		info, err := dockerCli.Info(context.Background())
+		if err != nil {
+			return
+		}
+		restore := container.Resources{
+			Memory:     previous.Memory,
+			MemorySwap: previous.MemorySwap,
+			NanoCPUs:   previous.NanoCPUs,
+			PidsLimit:  previous.PidsLimit,
+		}
+		if restore.Memory == 0 {
+			restore.Memory = info.MemTotal
+		}
+		if restore.MemorySwap == 0 {
+			restore.MemorySwap = -1
+		}
+		if restore.NanoCPUs == 0 {
+			restore.NanoCPUs = int64(info.NCPU) * 1e9
+		}
+		if restore.PidsLimit == nil || *restore.PidsLimit == 0 {
+			unlimited := int64(-1)
+			restore.PidsLimit = &unlimited
+		}
+		dockerCli.ContainerUpdate(context.Background(), containerID, container.UpdateConfig{Resources: restore})
+	}, nil
+}
+
+// oomKillCount reads how many processes the out of memory killer has killed
+// in a container, from cgroup v2 or v1 depending on what the docker machine
+// uses. -1 means it couldn't be read.
+func oomKillCount(containerName string) int {
+	for _, file := range []string{"/sys/fs/cgroup/memory.events", "/sys/fs/cgroup/memory/memory.oom_control"} {
+		out, err := exec.Command("docker", "exec", containerName, "cat", file).Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "oom_kill ") {
+				count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "oom_kill ")))
+				if err == nil {
+					return count
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// reportKilled explains an exit from SIGKILL, which is usually either the
+// out of memory killer or the user, since programs don't crash with it
+func reportKilled(containerName string, limits resourceLimits, oomBefore int) {
+	if limits.Memory == "" {
+		fmt.Fprintln(os.Stderr, "cbug: the program was killed (SIGKILL). If it ran out of memory, set a limit with --memory to find out.")
+		return
+	}
+	if oomBefore < 0 {
+		fmt.Fprintln(os.Stderr, "cbug: the program was killed (SIGKILL), but cbug could not tell if it ran out of memory.")
+		return
+	}
+	if oomKillCount(containerName) > oomBefore {
+		fmt.Fprintln(os.Stderr, "cbug: the program was killed by the out of memory killer after reaching the "+limits.Memory+" memory limit.")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "cbug: the program was killed (SIGKILL), but not for running out of memory.")
+}
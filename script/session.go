@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// A session keeps a container running for as long as the shell that started
+// it is open. A watcher process holds a lease on the container, so commands
+// from other shells won't stop it either, and applies the exit behaviour when
+// the shell exits or the session is ended.
+
+// sessionWatchCommand is the hidden command cbug starts itself with to watch
+// a session's shell
+const sessionWatchCommand = "__session-watch"
+
+// sessionFile records a shell's session on a container. It holds the pid of
+// the session's watcher.
+func sessionFile(containerName string, shellPid int) string {
+	return filepath.Join(stateDir(containerName), "sessions", strconv.Itoa(shellPid))
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// sessionWatcher gives the pid of the watcher for a shell's session, or 0 if
+// the shell has no session. Sessions whose watcher is gone are cleaned up.
+func sessionWatcher(containerName string, shellPid int) int {
+	file := sessionFile(containerName, shellPid)
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil || !processAlive(pid) {
+		os.Remove(file)
+		return 0
+	}
+	return pid
+}
+
+// inSession reports whether cbug was run from a shell with a session on the
+// container
+func inSession(containerName string) bool {
+	return sessionWatcher(containerName, os.Getppid()) != 0
+}
+
+// runSession handles cbug session start and cbug session end. The shell is
+// cbug's parent process.
+func runSession(execLoc string, containerName string, args []string) {
+	shellPid := os.Getppid()
+	if len(args) != 1 || (args[0] != "start" && args[0] != "end") {
+		fmt.Println("Usage: cbug session start|end")
+		os.Exit(1)
+	}
+
+	if args[0] == "start" {
+		if sessionWatcher(containerName, shellPid) != 0 {
+			fmt.Println("A cbug session for \"" + containerName + "\" is already running in this shell")
+			return
+		}
+		watcher := exec.Command(execLoc, sessionWatchCommand, containerName, strconv.Itoa(shellPid))
+		watcher.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		err := watcher.Start()
+		ifErr(err, "Error starting cbug session: ", true)
+		file := sessionFile(containerName, shellPid)
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			err = os.WriteFile(file, []byte(strconv.Itoa(watcher.Process.Pid)), 0644)
+		}
+		ifErr(err, "Error saving cbug session: ", true)
+		watcher.Process.Release()
+		fmt.Println("Started a cbug session for this shell. The container will keep running until the shell exits or \"cbug session end\" is run.")
+		return
+	}
+
+	pid := sessionWatcher(containerName, shellPid)
+	if pid == 0 {
+		fmt.Println("There is no cbug session for \"" + containerName + "\" in this shell")
+		return
+	}
+	//the watcher leaves without touching the container, and this command
+	//applies the exit behaviour once it is gone
+	syscall.Kill(pid, syscall.SIGTERM)
+	for i := 0; i < 50 && processAlive(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	os.Remove(sessionFile(containerName, shellPid))
+	fmt.Println("Ended cbug session")
+}
+
+// watchSession is the background watcher for a session. It holds a lease on
+// the container until the shell exits, then applies the exit behaviour.
+func watchSession(execLoc string, flags flagStruct, args []string) {
+	if len(args) != 2 {
+		os.Exit(1)
+	}
+	containerName := args[0]
+	shellPid, err := strconv.Atoi(args[1])
+	if err != nil {
+		os.Exit(1)
+	}
+	containerLease, err := acquireLease(containerName)
+	if err != nil {
+		os.Exit(1)
+	}
+	defer containerLease.release()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for processAlive(shellPid) {
+		select {
+		case <-signalChan:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	os.Remove(sessionFile(containerName, shellPid))
+	dockerCli, err := client.NewEnvClient()
+	if err != nil {
+		return
+	}
+	containerInfo, err := dockerCli.ContainerInspect(context.Background(), containerName)
+	if err != nil {
+		return
+	}
+	finishContainer(dockerCli, execLoc, containerLease, containerName, containerInfo.ID, flags)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// linuxSignals are the names of signals by their number in the container.
+// The numbers differ between linux and macos, so exit codes from the
+// container can't be turned into names with the syscall package.
+var linuxSignals = map[int]string{
+	1:  "SIGHUP",
+	2:  "SIGINT",
+	3:  "SIGQUIT",
+	4:  "SIGILL",
+	5:  "SIGTRAP",
+	6:  "SIGABRT",
+	7:  "SIGBUS",
+	8:  "SIGFPE",
+	9:  "SIGKILL",
+	10: "SIGUSR1",
+	11: "SIGSEGV",
+	12: "SIGUSR2",
+	13: "SIGPIPE",
+	14: "SIGALRM",
+	15: "SIGTERM",
+	24: "SIGXCPU",
+	25: "SIGXFSZ",
+}
+
+var signalDescriptions = map[string]string{
+	"SIGABRT": "aborted",
+	"SIGBUS":  "bus error",
+	"SIGFPE":  "floating point exception",
+	"SIGILL":  "illegal instruction",
+	"SIGINT":  "interrupted",
+	"SIGKILL": "killed",
+	"SIGSEGV": "segmentation fault",
+	"SIGTERM": "terminated",
+	"SIGXCPU": "cpu time limit exceeded",
+}
+
+// exitSignal gives the name of the signal that caused an exit code, or ""
+// if the command exited normally. Like a shell, the container reports a
+// command killed by a signal as 128 plus the signal's number.
+func exitSignal(exitCode int) string {
+	if exitCode <= 128 {
+		return ""
+	}
+	return linuxSignals[exitCode-128]
+}
+
+// forwardedSignals are passed on to the command in the container
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGQUIT,
+	syscall.SIGHUP,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// signalName is the name of a signal received by cbug, for use with kill in
+// the container
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGINT:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case syscall.SIGQUIT:
+		return "SIGQUIT"
+	case syscall.SIGHUP:
+		return "SIGHUP"
+	case syscall.SIGUSR1:
+		return "SIGUSR1"
+	case syscall.SIGUSR2:
+		return "SIGUSR2"
+	}
+	return ""
+}
+
+// linuxSignalNumber is the number of a signal in the container from its
+// name, or 0 if it isn't known
+func linuxSignalNumber(name string) int {
+	for number, signal := range linuxSignals {
+		if signal == name {
+			return number
+		}
+	}
+	return 0
+}
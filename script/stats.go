@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+)
+
+// resourceUsage is what --stats reports about a command
+type resourceUsage struct {
+	wall    time.Duration
+	cpu     time.Duration
+	peakRSS int64
+	maxFds  int
+	//sampled is false if the usage in the container couldn't be measured
+	sampled bool
+	//tooShort is set if the command exited before the first sample
+	tooShort bool
+}
+
+// usageSampler runs alongside a command in the container, adding up the cpu
+// time, highest peak rss and open files of the command and every process it
+// starts. It samples ten times a second until the command exits, then prints
+// what it found. It exits with 2 if the command was gone before the first
+// sample, so that zeros aren't reported for it.
+const usageSampler = `tries=0
+while [ ! -s "$1" ]; do
+	tries=$((tries + 1))
+	[ "$tries" -gt 100 ] && exit 1
+	sleep 0.05
+done
+root="$(cat "$1")"
+tree() {
+	echo "$1"
+	for child in $(cat /proc/"$1"/task/*/children 2>/dev/null); do tree "$child"; done
+}
+cpu=0; peak=0; fds=0; samples=0
+while [ -d /proc/"$root" ]; do
+	sampleCpu=0; sampleFds=0; found=0
+	for pid in $(tree "$root"); do
+		stat="$(cat /proc/"$pid"/stat 2>/dev/null)" || continue
+		found=1
+		set -- ${stat##*) }
+		sampleCpu=$((sampleCpu + ${12} + ${13} + ${14} + ${15}))
+		rss="$(awk '/^VmHWM/ {print $2}' /proc/"$pid"/status 2>/dev/null)"
+		[ "${rss:-0}" -gt "$peak" ] && peak="$rss"
+		sampleFds=$((sampleFds + $(ls /proc/"$pid"/fd 2>/dev/null | wc -l)))
+	done
+	[ "$found" = 1 ] || break
+	samples=$((samples + 1))
+	[ "$sampleCpu" -gt "$cpu" ] && cpu="$sampleCpu"
+	[ "$sampleFds" -gt "$fds" ] && fds="$sampleFds"
+	sleep 0.1
+done
+[ "$samples" -gt 0 ] || exit 2
+echo "$cpu $(getconf CLK_TCK) $peak $fds"`
+
+// sampleUsage starts the usage sampler for a command started with trackPid.
+// The channel receives once the command has exited.
+func sampleUsage(session *execSession) <-chan resourceUsage {
+	samples := make(chan resourceUsage, 1)
+	go func() {
+		var out bytes.Buffer
+		usage := resourceUsage{}
+		cmd := []string{"sh", "-c", usageSampler, "cbug", session.pidFile}
+		exitCode, err := runExec(session.dockerCli, session.containerID, cmd, &out, io.Discard)
+		if err == nil && exitCode == 2 {
+			usage.tooShort = true
+		} else if err == nil && exitCode == 0 {
+			fields := strings.Fields(out.String())
+			values := make([]int64, len(fields))
+			for i, field := range fields {
+				values[i], err = strconv.ParseInt(field, 10, 64)
+			}
+			if err == nil && len(values) == 4 && values[1] > 0 {
+				usage.cpu = time.Duration(values[0]) * time.Second / time.Duration(values[1])
+				usage.peakRSS = values[2] * 1024
+				usage.maxFds = int(values[3])
+				usage.sampled = true
+			}
+		}
+		samples <- usage
+	}()
+	return samples
+}
+
+// printUsage prints the --stats report
+func printUsage(usage resourceUsage) {
+	fmt.Fprintln(os.Stderr, "cbug stats:")
+	table := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "\twall time\t"+usage.wall.Round(time.Millisecond).String())
+	if usage.sampled {
+		fmt.Fprintln(table, "\tcpu time\t"+usage.cpu.Round(time.Millisecond).String())
+		fmt.Fprintln(table, "\tpeak memory (rss)\t"+units.BytesSize(float64(usage.peakRSS)))
+		fmt.Fprintln(table, "\tmax open files\t"+strconv.Itoa(usage.maxFds))
+	} else if usage.tooShort {
+		fmt.Fprintln(table, "\t(cpu time, memory and open files not sampled, the command exited too quickly)\t")
+	} else {
+		fmt.Fprintln(table, "\t(cpu time, memory and open files could not be measured)\t")
+	}
+	table.Flush()
+}
+
+// containerStats is the latest usage of one container for cbug top
+type containerStats struct {
+	name     string
+	cpu      float64
+	memory   uint64
+	limit    uint64
+	pids     uint64
+	received bool
+}
+
+func (c *containerStats) update(stats types.StatsJSON) {
+	c.received = true
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	c.cpu = 0
+	if cpuDelta > 0 && systemDelta > 0 {
+		c.cpu = cpuDelta / systemDelta * cpus * 100
+	}
+	//the page cache isn't memory the programs are using, and docker stats
+	//leaves it out too
+	c.memory = stats.MemoryStats.Usage
+	for _, cache := range []string{"inactive_file", "total_inactive_file", "cache"} {
+		if value, exists := stats.MemoryStats.Stats[cache]; exists && value < c.memory {
+			c.memory -= value
+			break
+		}
+	}
+	c.limit = stats.MemoryStats.Limit
+	c.pids = stats.PidsStats.Current
+}
+
+// runTop shows the cpu, memory and process count of every running cbug
+// container, updating every second until ctrl-c. When the output isn't a
+// terminal, it prints one update and exits.
+func runTop(dockerCli *client.Client, conf configStruct) {
+	containers, err := dockerCli.ContainerList(context.Background(), types.ContainerListOptions{})
+	ifErr(err, "Docker Error: ", true)
+
+	type update struct {
+		id    string
+		stats types.StatsJSON
+	}
+	updates := make(chan update)
+	stats := map[string]*containerStats{}
+	for _, dContainer := range containers {
+		if !isCbugContainer(conf, dContainer) || len(dContainer.Names) == 0 {
+			continue
+		}
+		stats[dContainer.ID] = &containerStats{name: strings.TrimPrefix(dContainer.Names[0], "/")}
+		go func(id string) {
+			response, err := dockerCli.ContainerStats(context.Background(), id, true)
+			if err != nil {
+				return
+			}
+			defer response.Body.Close()
+			decoder := json.NewDecoder(response.Body)
+			for {
+				var containerUpdate update
+				containerUpdate.id = id
+				if decoder.Decode(&containerUpdate.stats) != nil {
+					return
+				}
+				updates <- containerUpdate
+			}
+		}(dContainer.ID)
+	}
+	if len(stats) == 0 {
+		fmt.Println("There are no running cbug containers")
+		return
+	}
+
+	live := term.IsTerminal(os.Stdout.Fd())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for waited := 0; ; waited++ {
+		select {
+		case containerUpdate := <-updates:
+			stats[containerUpdate.id].update(containerUpdate.stats)
+			waited--
+			continue
+		case <-ticker.C:
+		}
+		//without a terminal, wait a little for every container to send its
+		//first update before printing
+		ready := true
+		for _, container := range stats {
+			ready = ready && container.received
+		}
+		if !live && !ready && waited < 5 {
+			continue
+		}
+		if live {
+			//clear the screen to draw over the last update
+			fmt.Print("\033[H\033[2J")
+		}
+		printTop(stats)
+		if !live {
+			return
+		}
+	}
+}
+
+func printTop(stats map[string]*containerStats) {
+	containers := []*containerStats{}
+	for _, container := range stats {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].name < containers[j].name })
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tCPU %\tMEMORY\tLIMIT\tPIDS")
+	for _, container := range containers {
+		if !container.received {
+			fmt.Fprintln(table, container.name+"\t-\t-\t-\t-")
+			continue
+		}
+		fmt.Fprintln(table, container.name+"\t"+
+			strconv.FormatFloat(container.cpu, 'f', 1, 64)+"\t"+
+			units.BytesSize(float64(container.memory))+"\t"+
+			units.BytesSize(float64(container.limit))+"\t"+
+			strconv.FormatUint(container.pids, 10))
+	}
+	table.Flush()
+}
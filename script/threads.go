@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// threadsOptions are the options given to cbug threads
+type threadsOptions struct {
+	//xmlFile is where valgrind writes its findings in the container
+	xmlFile string
+	drd     bool
+}
+
+// threadsCommand builds the command for cbug threads, which runs a program
+// under helgrind, or drd with --drd, to find data races and locking mistakes
+func threadsCommand(args []string) ([]string, threadsOptions) {
+	opts := threadsOptions{}
+	if len(args) > 0 && args[0] == "--drd" {
+		opts.drd = true
+		args = args[1:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: cbug threads [--drd] <program> [args]")
+		os.Exit(1)
+	}
+	opts.xmlFile = pidDir + "/threads." + strconv.FormatInt(time.Now().UnixNano(), 36) + ".xml"
+	tool := "--tool=helgrind"
+	if opts.drd {
+		tool = "--tool=drd"
+	}
+	return append([]string{"valgrind", tool, "--xml=yes", "--xml-file=" + opts.xmlFile}, args...), opts
+}
+
+type valgrindFrame struct {
+	Fn   string `xml:"fn"`
+	Obj  string `xml:"obj"`
+	Dir  string `xml:"dir"`
+	File string `xml:"file"`
+	Line int    `xml:"line"`
+}
+
+type valgrindStack struct {
+	Frames []valgrindFrame `xml:"frame"`
+}
+
+type valgrindText struct {
+	Text string `xml:"text"`
+}
+
+// valgrindDetail is a line of explanation or a stack in an error
+type valgrindDetail struct {
+	text  string
+	stack *valgrindStack
+}
+
+// valgrindError is one error from valgrind's xml output. What each stack in
+// an error is depends on the text before it, so the details are kept in
+// order. helgrind gives the conflicting access as a second stack, and drd
+// gives where the other thread's conflicting code started.
+type valgrindError struct {
+	unique  string
+	kind    string
+	what    string
+	details []valgrindDetail
+	stacks  []valgrindStack
+}
+
+func (e *valgrindError) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.EndElement:
+			return nil
+		case xml.StartElement:
+			var text string
+			var detail valgrindText
+			var stack valgrindStack
+			var segment struct {
+				Stack valgrindStack `xml:"stack"`
+			}
+			switch token.Name.Local {
+			case "unique":
+				err = decoder.DecodeElement(&e.unique, &token)
+			case "kind":
+				err = decoder.DecodeElement(&e.kind, &token)
+			case "what":
+				err = decoder.DecodeElement(&e.what, &token)
+			case "xwhat":
+				err = decoder.DecodeElement(&detail, &token)
+				e.what = detail.Text
+			case "auxwhat":
+				err = decoder.DecodeElement(&text, &token)
+				e.details = append(e.details, valgrindDetail{text: text})
+			case "xauxwhat":
+				err = decoder.DecodeElement(&detail, &token)
+				e.details = append(e.details, valgrindDetail{text: detail.Text})
+			case "stack":
+				err = decoder.DecodeElement(&stack, &token)
+				e.stacks = append(e.stacks, stack)
+				e.details = append(e.details, valgrindDetail{stack: &stack})
+			case "other_segment_start":
+				err = decoder.DecodeElement(&segment, &token)
+				if len(segment.Stack.Frames) > 0 {
+					e.stacks = append(e.stacks, segment.Stack)
+					e.details = append(e.details, valgrindDetail{text: "The other thread's conflicting code started in:"}, valgrindDetail{stack: &segment.Stack})
+				}
+			default:
+				err = decoder.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pair gives the stack the error happened in, and the one it conflicts with
+// if there is one
+func (e valgrindError) pair() (valgrindStack, valgrindStack) {
+	var first, second valgrindStack
+	if len(e.stacks) > 0 {
+		first = e.stacks[0]
+	}
+	if len(e.stacks) > 1 {
+		second = e.stacks[1]
+	}
+	return first, second
+}
+
+// programFrames are the frames of a stack in the program's own code, rather
+// than valgrind's or the system's. If there aren't any, the whole stack is
+// used.
+func programFrames(stack valgrindStack) []valgrindFrame {
+	frames := []valgrindFrame{}
+	for _, frame := range stack.Frames {
+		if frame.File == "" || strings.HasPrefix(frame.Dir, "/usr/") || strings.Contains(frame.Obj, "valgrind") {
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) == 0 {
+		return stack.Frames
+	}
+	return frames
+}
+
+// signature identifies a stack by where it is in the program, so that the
+// same race at different addresses, like different elements of an array, is
+// only shown once
+func (stack valgrindStack) signature() string {
+	frames := programFrames(stack)
+	if len(frames) > 3 {
+		frames = frames[:3]
+	}
+	parts := []string{}
+	for _, frame := range frames {
+		parts = append(parts, frame.Fn+"@"+frame.File+":"+strconv.Itoa(frame.Line))
+	}
+	return strings.Join(parts, ";")
+}
+
+// threadFinding is a group of errors from the same pair of stacks
+type threadFinding struct {
+	example valgrindError
+	count   int
+}
+
+var threadKinds = map[string]string{
+	"Race":              "Data race",
+	"ConflictingAccess": "Data race",
+	"LockOrder":         "Lock order violation",
+}
+
+func threadKind(kind string) string {
+	if name, exists := threadKinds[kind]; exists {
+		return name
+	}
+	return "Thread API misuse (" + kind + ")"
+}
+
+// parseThreadErrors reads the errors from valgrind's xml output, with how
+// many times each was reported. The output is read as a stream, so errors
+// are still found if the program was killed before valgrind finished it.
+func parseThreadErrors(r io.Reader) ([]valgrindError, map[string]int) {
+	errors := []valgrindError{}
+	counts := map[string]int{}
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "error":
+			var valgrindErr valgrindError
+			if decoder.DecodeElement(&valgrindErr, &start) == nil {
+				errors = append(errors, valgrindErr)
+			}
+		case "pair":
+			var pair struct {
+				Count  int    `xml:"count"`
+				Unique string `xml:"unique"`
+			}
+			if decoder.DecodeElement(&pair, &start) == nil {
+				counts[pair.Unique] = pair.Count
+			}
+		}
+	}
+	return errors, counts
+}
+
+// groupThreadErrors groups errors of the same kind between the same pair of
+// stacks, in either order. The groups with the most reports come first.
+func groupThreadErrors(errors []valgrindError, counts map[string]int) []*threadFinding {
+	groups := map[string]*threadFinding{}
+	findings := []*threadFinding{}
+	for _, valgrindErr := range errors {
+		first, second := valgrindErr.pair()
+		pair := []string{first.signature(), second.signature()}
+		sort.Strings(pair)
+		key := threadKind(valgrindErr.kind) + "\x00" + pair[0] + "\x00" + pair[1]
+		count := counts[valgrindErr.unique]
+		if count == 0 {
+			count = 1
+		}
+		if finding, exists := groups[key]; exists {
+			finding.count += count
+			continue
+		}
+		groups[key] = &threadFinding{example: valgrindErr, count: count}
+		findings = append(findings, groups[key])
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].count > findings[j].count })
+	return findings
+}
+
+func printThreadStack(out io.Writer, hostRoot string, stack valgrindStack) {
+	frames := programFrames(stack)
+	if len(frames) > 6 {
+		frames = frames[:6]
+	}
+	for _, frame := range frames {
+		location := frame.Obj
+		if frame.File != "" {
+			location = hostPath(hostRoot, path.Join(frame.Dir, frame.File)) + ":" + strconv.Itoa(frame.Line)
+		}
+		fmt.Fprintln(out, "        at "+frame.Fn+" ("+location+")")
+	}
+}
+
+// reportThreads copies valgrind's xml out of the container, and prints its
+// findings grouped by the stacks involved
+func reportThreads(conf configStruct, opts threadsOptions) {
+	file, err := os.CreateTemp("", "cbug-threads-*.xml")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the findings: "+err.Error())
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	tool := "helgrind"
+	if opts.drd {
+		tool = "drd"
+	}
+	if err := moveOut(conf, opts.xmlFile, file.Name()); err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: "+tool+" didn't write its findings")
+		return
+	}
+
+	file, err = os.Open(file.Name())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cbug: unable to read the findings: "+err.Error())
+		return
+	}
+	errors, counts := parseThreadErrors(file)
+	file.Close()
+	findings := groupThreadErrors(errors, counts)
+	if len(findings) == 0 {
+		fmt.Fprintln(os.Stderr, "cbug threads: "+tool+" found no data races or locking problems")
+		return
+	}
+
+	hostRoot := projectRoot(conf)
+	fmt.Fprintln(os.Stderr, "cbug threads: "+tool+" found "+strconv.Itoa(len(findings))+" problems:")
+	for i, finding := range findings {
+		valgrindErr := finding.example
+		reports := "1 report"
+		if finding.count != 1 {
+			reports = strconv.Itoa(finding.count) + " reports"
+		}
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, strconv.Itoa(i+1)+". "+threadKind(valgrindErr.kind)+" ("+reports+")")
+		fmt.Fprintln(os.Stderr, "    "+valgrindErr.what)
+		for _, detail := range valgrindErr.details {
+			if detail.stack != nil {
+				printThreadStack(os.Stderr, hostRoot, *detail.stack)
+			} else {
+				fmt.Fprintln(os.Stderr, "    "+detail.text)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// helgrindRace is a helgrind race between two threads running worker, at
+// the given address
+func helgrindRace(unique string, address string) string {
+	return `<error>
+  <unique>` + unique + `</unique>
+  <tid>2</tid>
+  <kind>Race</kind>
+  <xwhat>
+    <text>Possible data race during write of size 4 at ` + address + ` by thread #2</text>
+    <hthreadid>2</hthreadid>
+  </xwhat>
+  <xauxwhat><text>Locks held: none</text></xauxwhat>
+  <stack>
+    <frame><ip>0x109189</ip><obj>/debugger/a.out</obj><fn>worker</fn><dir>/debugger</dir><file>race.c</file><line>6</line></frame>
+    <frame><ip>0x484F4F</ip><obj>/usr/libexec/valgrind/vgpreload_helgrind-amd64-linux.so</obj><fn>mythread_wrapper</fn><dir>/build/valgrind/helgrind</dir><file>hg_intercepts.c</file><line>406</line></frame>
+  </stack>
+  <xauxwhat><text>This conflicts with a previous write of size 4 by thread #3</text><hthreadid>3</hthreadid></xauxwhat>
+  <stack>
+    <frame><ip>0x109189</ip><obj>/debugger/a.out</obj><fn>worker</fn><dir>/debugger</dir><file>race.c</file><line>6</line></frame>
+  </stack>
+</error>
+`
+}
+
+const helgrindLockOrder = `<error>
+  <unique>0x3</unique>
+  <tid>1</tid>
+  <kind>LockOrder</kind>
+  <xwhat><text>Thread #1: lock order "0x10C040 before 0x10C080" violated</text><hthreadid>1</hthreadid></xwhat>
+  <stack>
+    <frame><ip>0x1091F0</ip><obj>/debugger/a.out</obj><fn>second</fn><dir>/debugger</dir><file>locks.c</file><line>20</line></frame>
+  </stack>
+  <auxwhat>Required order was established by acquisition of lock at 0x10C040</auxwhat>
+  <stack>
+    <frame><ip>0x1091A0</ip><obj>/debugger/a.out</obj><fn>first</fn><dir>/debugger</dir><file>locks.c</file><line>10</line></frame>
+  </stack>
+</error>
+`
+
+const drdConflict = `<error>
+  <unique>0x0</unique>
+  <tid>2</tid>
+  <kind>ConflictingAccess</kind>
+  <what>Conflicting store by thread 2 at 0x0010c014 size 4</what>
+  <stack>
+    <frame><ip>0x109189</ip><obj>/debugger/a.out</obj><fn>worker</fn><dir>/debugger</dir><file>race.c</file><line>6</line></frame>
+  </stack>
+  <auxwhat>Allocation context: BSS section of /debugger/a.out</auxwhat>
+  <other_segment_start>
+    <stack>
+      <frame><ip>0x1091C0</ip><obj>/debugger/a.out</obj><fn>main</fn><dir>/debugger</dir><file>race.c</file><line>14</line></frame>
+    </stack>
+  </other_segment_start>
+  <other_segment_end>
+    <stack>
+      <frame><ip>0x1091D0</ip><obj>/debugger/a.out</obj><fn>main</fn><dir>/debugger</dir><file>race.c</file><line>15</line></frame>
+    </stack>
+  </other_segment_end>
+</error>
+`
+
+func TestParseThreadErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		xml         string
+		wantUniques []string
+		wantKinds   []string
+		wantCounts  map[string]int
+	}{
+		{
+			"helgrind",
+			`<?xml version="1.0"?>
+<valgrindoutput>
+<protocolversion>4</protocolversion>
+<protocoltool>helgrind</protocoltool>
+` + helgrindRace("0x1", "0x10C014") + helgrindRace("0x2", "0x10C018") + helgrindLockOrder + `
+<errorcounts>
+  <pair><count>3</count><unique>0x1</unique></pair>
+  <pair><count>2</count><unique>0x2</unique></pair>
+</errorcounts>
+</valgrindoutput>
+`,
+			[]string{"0x1", "0x2", "0x3"},
+			[]string{"Race", "Race", "LockOrder"},
+			map[string]int{"0x1": 3, "0x2": 2},
+		},
+		{
+			"drd",
+			`<?xml version="1.0"?>
+<valgrindoutput>
+<protocoltool>drd</protocoltool>
+` + drdConflict + `
+</valgrindoutput>
+`,
+			[]string{"0x0"},
+			[]string{"ConflictingAccess"},
+			map[string]int{},
+		},
+		{
+			"killed before valgrind finished",
+			`<?xml version="1.0"?>
+<valgrindoutput>
+` + helgrindRace("0x1", "0x10C014") + `<error>
+  <unique>0x2</unique>
+  <kind>Ra`,
+			[]string{"0x1"},
+			[]string{"Race"},
+			map[string]int{},
+		},
+		{
+			"empty",
+			``,
+			[]string{},
+			[]string{},
+			map[string]int{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors, counts := parseThreadErrors(strings.NewReader(test.xml))
+			uniques, kinds := []string{}, []string{}
+			for _, valgrindErr := range errors {
+				uniques = append(uniques, valgrindErr.unique)
+				kinds = append(kinds, valgrindErr.kind)
+			}
+			if !reflect.DeepEqual(uniques, test.wantUniques) || !reflect.DeepEqual(kinds, test.wantKinds) {
+				t.Errorf("errors = %q %q, want %q %q", uniques, kinds, test.wantUniques, test.wantKinds)
+			}
+			if !reflect.DeepEqual(counts, test.wantCounts) {
+				t.Errorf("counts = %v, want %v", counts, test.wantCounts)
+			}
+		})
+	}
+}
+
+func TestParseThreadErrorDetails(t *testing.T) {
+	tests := []struct {
+		name        string
+		xml         string
+		wantWhat    string
+		wantDetails []string
+		wantStacks  int
+	}{
+		{
+			"helgrind race",
+			helgrindRace("0x1", "0x10C014"),
+			"Possible data race during write of size 4 at 0x10C014 by thread #2",
+			[]string{"Locks held: none", "stack", "This conflicts with a previous write of size 4 by thread #3", "stack"},
+			2,
+		},
+		{
+			"drd conflict",
+			drdConflict,
+			"Conflicting store by thread 2 at 0x0010c014 size 4",
+			[]string{"stack", "Allocation context: BSS section of /debugger/a.out", "The other thread's conflicting code started in:", "stack"},
+			2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors, _ := parseThreadErrors(strings.NewReader(test.xml))
+			if len(errors) != 1 {
+				t.Fatalf("got %d errors, want 1", len(errors))
+			}
+			valgrindErr := errors[0]
+			if valgrindErr.what != test.wantWhat {
+				t.Errorf("what = %q, want %q", valgrindErr.what, test.wantWhat)
+			}
+			details := []string{}
+			for _, detail := range valgrindErr.details {
+				if detail.stack != nil {
+					details = append(details, "stack")
+				} else {
+					details = append(details, detail.text)
+				}
+			}
+			if !reflect.DeepEqual(details, test.wantDetails) {
+				t.Errorf("details = %q, want %q", details, test.wantDetails)
+			}
+			if len(valgrindErr.stacks) != test.wantStacks {
+				t.Errorf("got %d stacks, want %d", len(valgrindErr.stacks), test.wantStacks)
+			}
+		})
+	}
+}
+
+func TestGroupThreadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		xml    string
+		kinds  []string
+		counts []int
+	}{
+		{
+			"same race at different addresses",
+			helgrindRace("0x1", "0x10C014") + helgrindRace("0x2", "0x10C018") + helgrindLockOrder + `
+<errorcounts>
+  <pair><count>3</count><unique>0x1</unique></pair>
+  <pair><count>2</count><unique>0x2</unique></pair>
+</errorcounts>`,
+			[]string{"Data race", "Lock order violation"},
+			[]int{5, 1},
+		},
+		{
+			"most reports first",
+			helgrindLockOrder + helgrindRace("0x1", "0x10C014") + `
+<errorcounts>
+  <pair><count>1</count><unique>0x3</unique></pair>
+  <pair><count>7</count><unique>0x1</unique></pair>
+</errorcounts>`,
+			[]string{"Data race", "Lock order violation"},
+			[]int{7, 1},
+		},
+		{
+			"drd",
+			drdConflict,
+			[]string{"Data race"},
+			[]int{1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			findings := groupThreadErrors(parseThreadErrors(strings.NewReader("<valgrindoutput>" + test.xml + "</valgrindoutput>")))
+			kinds, counts := []string{}, []int{}
+			for _, finding := range findings {
+				kinds = append(kinds, threadKind(finding.example.kind))
+				counts = append(counts, finding.count)
+			}
+			if !reflect.DeepEqual(kinds, test.kinds) || !reflect.DeepEqual(counts, test.counts) {
+				t.Errorf("findings = %q %v, want %q %v", kinds, counts, test.kinds, test.counts)
+			}
+		})
+	}
+}
+
+func TestThreadStackSignature(t *testing.T) {
+	errors, _ := parseThreadErrors(strings.NewReader(helgrindRace("0x1", "0x10C014")))
+	if len(errors) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errors))
+	}
+	first, second := errors[0].pair()
+	//valgrind's own frames are left out
+	want := "worker@race.c:6"
+	if first.signature() != want || second.signature() != want {
+		t.Errorf("signatures = %q, %q, want %q", first.signature(), second.signature(), want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/klauspost/cpuid/v2"
+)
+
+// these are set at build time with
+// -ldflags "-X main.version=v1.2.0 -X main.platform=macos -X main.architecture=arm64"
+// anything left empty is worked out from the machine cbug is running on, and
+// the version from the module version go install records
+var (
+	version      = ""
+	platform     = ""
+	architecture = ""
+)
+
+// hostArch returns the architecture of the machine, not of the binary. An x86
+// build running through rosetta on apple silicon reports itself as amd64, but
+// the cpu brand gives it away, and an arm container will run natively there.
+func hostArch() string {
+	if runtime.GOARCH == "amd64" && strings.Contains(cpuid.CPU.BrandName, "VirtualApple") {
+		return "arm64"
+	}
+	return runtime.GOARCH
+}
+
+// buildVersion is the version go install built cbug from, or "dev" for a
+// build from a local checkout, which has no version
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+func hostPlatform() string {
+	if runtime.GOOS == "darwin" {
+		return "macos"
+	}
+	return runtime.GOOS
+}
+
+// loadReleaseInfo builds the release info from the values embedded at build
+// time. A release-info.json next to the cbug folder is still read if present,
+// and any values in it override the embedded ones.
+func loadReleaseInfo(execLoc string) (infoStruct, error) {
+	info := infoStruct{
+		Version:            version,
+		Platform:           platform,
+		ArchitectureString: architecture,
+	}
+	if info.Version == "" {
+		info.Version = buildVersion()
+	}
+	if info.Platform == "" {
+		info.Platform = hostPlatform()
+	}
+	if info.ArchitectureString == "" {
+		info.ArchitectureString = hostArch()
+	}
+
+	infoFile, err := os.ReadFile(filepath.Dir(execLoc) + "/../release-info.json")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return info, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(infoFile, &info); err != nil {
+			return info, errors.New("release-info.json is not valid json: " + err.Error())
+		}
+	}
+	return info, nil
+}